@@ -1,9 +1,13 @@
 package client
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -18,10 +22,68 @@ import (
 	"github.com/kopoli/appkit"
 )
 
+var (
+	// ErrPreconditionFailed is returned when the If-Match or If-None-Match
+	// condition of a write is not met
+	ErrPreconditionFailed = errors.New("Precondition failed")
+
+	// ErrNotModified is returned when a conditional get finds the data
+	// unchanged
+	ErrNotModified = errors.New("Not modified")
+)
+
 type Client struct {
 	Http *http.Client
 	Url  *url.URL
 	Ctx  context.Context
+
+	// Token is sent as the bearer token of the requests if it is set
+	Token string
+}
+
+// loadCertPool reads a PEM bundle of CA certificates
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificates found in %s", filename)
+	}
+	return pool, nil
+}
+
+// tlsConfig creates the TLS configuration of the client from the
+// tls-ca, tls-cert and tls-key options. Returns nil if none of them are
+// set.
+func tlsConfig(opts appkit.Options) (*tls.Config, error) {
+	if !opts.IsSet("tls-ca") && !opts.IsSet("tls-cert") {
+		return nil, nil
+	}
+
+	ret := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	var err error
+	if opts.IsSet("tls-ca") {
+		ret.RootCAs, err = loadCertPool(opts.Get("tls-ca", ""))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.IsSet("tls-cert") {
+		cert, err := tls.LoadX509KeyPair(opts.Get("tls-cert", ""), opts.Get("tls-key", ""))
+		if err != nil {
+			return nil, err
+		}
+		ret.Certificates = []tls.Certificate{cert}
+	}
+
+	return ret, nil
 }
 
 func NewClient(URL string, opts appkit.Options) (*Client, error) {
@@ -43,11 +105,17 @@ func NewClient(URL string, opts appkit.Options) (*Client, error) {
 
 	u.Path = path.Join(u.Path, "api")
 
+	tlsConf, err := tlsConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	tr := &http.Transport{
 		Dial: (&net.Dialer{
 			Timeout: parseTimeout("timeout-dial", 5),
 		}).Dial,
 		TLSHandshakeTimeout: parseTimeout("timeout-tls-handshake", 5),
+		TLSClientConfig:     tlsConf,
 	}
 
 	return &Client{
@@ -55,24 +123,45 @@ func NewClient(URL string, opts appkit.Options) (*Client, error) {
 			Timeout:   parseTimeout("timeout-http-client", 10),
 			Transport: tr,
 		},
-		Url: u,
-		Ctx: nil,
+		Url:   u,
+		Ctx:   nil,
+		Token: opts.Get("token", ""),
 	}, nil
 }
 
-func (c *Client) createReq(method, urlpath string, r io.Reader) (*http.Request, error) {
+func (c *Client) createReq(method, urlpath string, query url.Values, header http.Header, r io.Reader) (*http.Request, error) {
 	u := *c.Url
 	u.Path = path.Join(u.Path, urlpath)
+	if urlpath == "/" {
+		// The root of the API is /api/
+		u.Path += "/"
+	}
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
 
+	var req *http.Request
+	var err error
 	if c.Ctx != nil {
-		return http.NewRequestWithContext(c.Ctx, method, u.String(), r)
+		req, err = http.NewRequestWithContext(c.Ctx, method, u.String(), r)
 	} else {
-		return http.NewRequest(method, u.String(), r)
+		req, err = http.NewRequest(method, u.String(), r)
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	return req, nil
 }
 
-func (c *Client) doRequest(request, urlpath string, r io.Reader) (*http.Response, error) {
-	req, err := c.createReq(request, urlpath, r)
+func (c *Client) doRequest(request, urlpath string, query url.Values, header http.Header, r io.Reader) (*http.Response, error) {
+	req, err := c.createReq(request, urlpath, query, header, r)
 	if err != nil {
 		return nil, err
 	}
@@ -83,14 +172,34 @@ func (c *Client) doRequest(request, urlpath string, r io.Reader) (*http.Response
 	switch resp.StatusCode {
 	case http.StatusOK:
 		return resp, err
+	case http.StatusNotModified:
+		resp.Body.Close()
+		return nil, ErrNotModified
+	case http.StatusPreconditionFailed:
+		resp.Body.Close()
+		return nil, ErrPreconditionFailed
 	default:
+		resp.Body.Close()
+		if id := resp.Header.Get("X-Request-ID"); id != "" {
+			return nil, fmt.Errorf("Received %d %s (request %s)", resp.StatusCode,
+				resp.Status, id)
+		}
 		return nil, fmt.Errorf("Received %d %s", resp.StatusCode,
 			resp.Status)
 	}
 }
 
-func (c *Client) GetRaw(urlpath string) ([]string, error) {
-	resp, err := c.doRequest("GET", urlpath, nil)
+// getData GETs the urlpath and unmarshals the data part of the response
+// into data.
+func (c *Client) getData(urlpath string, query url.Values, data interface{}) error {
+	_, err := c.getDataHeader(urlpath, query, nil, data)
+	return err
+}
+
+// getDataHeader is getData with request headers. Returns the response
+// headers.
+func (c *Client) getDataHeader(urlpath string, query url.Values, header http.Header, data interface{}) (http.Header, error) {
+	resp, err := c.doRequest("GET", urlpath, query, header, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -101,51 +210,230 @@ func (c *Client) GetRaw(urlpath string) ([]string, error) {
 		return nil, err
 	}
 
-	type data struct {
-		Status string `json:"status"`
-		Data   []struct {
-			Date string
-			Path string
-			Id   float64
-			Text string
-		} `json:"data"`
+	var d struct {
+		Status string          `json:"status"`
+		Data   json.RawMessage `json:"data"`
 	}
 
-	var d data
 	err = json.Unmarshal(body, &d)
 	if err != nil {
 		return nil, err
 	}
 
 	if d.Status != "success" {
-		err = fmt.Errorf("%v", d.Data)
+		return nil, fmt.Errorf("%s", d.Data)
 	}
 
-	ret := make([]string, 0, len(d.Data))
-	for i := range d.Data {
-		s := d.Data[i].Text
-		ret = append(ret, s)
+	return resp.Header, json.Unmarshal(d.Data, data)
+}
+
+type content struct {
+	Date string
+	Path string
+	Id   float64
+	Text string
+}
+
+func texts(data []content) []string {
+	ret := make([]string, 0, len(data))
+	for i := range data {
+		ret = append(ret, data[i].Text)
 	}
-	return ret, err
+	return ret
 }
 
+func (c *Client) getRaw(urlpath string, query url.Values) ([]string, error) {
+	var d []content
+	err := c.getData(urlpath, query, &d)
+	if err != nil {
+		return nil, err
+	}
+	return texts(d), nil
+}
+
+func unmarshalAll(js []string, values interface{}) error {
+	whole := `[` + strings.Join(js, `,`) + `]`
+	return json.Unmarshal([]byte(whole), values)
+}
+
+// GetRaw gets the JSON of the latest revision of the urlpath
+func (c *Client) GetRaw(urlpath string) ([]string, error) {
+	return c.getRaw(urlpath, nil)
+}
+
+// Get unmarshals the latest revision of the urlpath into values, which
+// should be a pointer to a slice
 func (c *Client) Get(urlpath string, values interface{}) error {
 	js, err := c.GetRaw(urlpath)
 	if err != nil {
 		return err
 	}
 
-	whole := `[` + strings.Join(js, `,`) + `]`
-	err = json.Unmarshal([]byte(whole), values)
-	return err
+	return unmarshalAll(js, values)
 }
 
-func (c *Client) PutRaw(urlpath string, json []byte) error {
+// GetRawRecursive gets the JSON of the latest revisions of the urlpath and
+// the paths below it
+func (c *Client) GetRawRecursive(urlpath string) ([]string, error) {
+	return c.getRaw(urlpath, url.Values{"recursive": {""}})
+}
+
+// GetRecursive unmarshals the latest revisions of the urlpath and the paths
+// below it into values, which should be a pointer to a slice
+func (c *Client) GetRecursive(urlpath string, values interface{}) error {
+	js, err := c.GetRawRecursive(urlpath)
+	if err != nil {
+		return err
+	}
+
+	return unmarshalAll(js, values)
+}
+
+func asOf(at time.Time, recursive bool) url.Values {
+	ret := url.Values{"as-of": {at.Format(time.RFC3339Nano)}}
+	if recursive {
+		ret.Set("recursive", "")
+	}
+	return ret
+}
+
+// GetRawAt gets the JSON of the urlpath as it was at the given time
+func (c *Client) GetRawAt(urlpath string, at time.Time) ([]string, error) {
+	return c.getRaw(urlpath, asOf(at, false))
+}
+
+// GetAt unmarshals the urlpath as it was at the given time into values,
+// which should be a pointer to a slice
+func (c *Client) GetAt(urlpath string, at time.Time, values interface{}) error {
+	js, err := c.GetRawAt(urlpath, at)
+	if err != nil {
+		return err
+	}
+
+	return unmarshalAll(js, values)
+}
+
+// GetRawRecursiveAt gets the JSON of the urlpath and the paths below it as
+// they were at the given time
+func (c *Client) GetRawRecursiveAt(urlpath string, at time.Time) ([]string, error) {
+	return c.getRaw(urlpath, asOf(at, true))
+}
+
+// GetRecursiveAt unmarshals the urlpath and the paths below it as they were
+// at the given time into values, which should be a pointer to a slice
+func (c *Client) GetRecursiveAt(urlpath string, at time.Time, values interface{}) error {
+	js, err := c.GetRawRecursiveAt(urlpath, at)
+	if err != nil {
+		return err
+	}
+
+	return unmarshalAll(js, values)
+}
+
+// GetRawIfNoneMatch gets the JSON of the latest revision of the urlpath
+// unless its entity tag matches etag. Returns ErrNotModified if it
+// matches. Returns also the entity tag of the latest revision.
+func (c *Client) GetRawIfNoneMatch(urlpath string, etag string) (string, string, error) {
+	var header http.Header
+	if etag != "" {
+		header = http.Header{"If-None-Match": {etag}}
+	}
+
+	var d []content
+	h, err := c.getDataHeader(urlpath, nil, header, &d)
+	if err != nil {
+		return "", "", err
+	}
+	if len(d) == 0 {
+		return "", "", fmt.Errorf("No content in %s", urlpath)
+	}
+	return d[0].Text, h.Get("ETag"), nil
+}
+
+// GetIfNoneMatch unmarshals the latest revision of the urlpath into value
+// unless its entity tag matches etag. Returns ErrNotModified if it
+// matches. Returns also the entity tag of the latest revision.
+func (c *Client) GetIfNoneMatch(urlpath string, etag string, value interface{}) (string, error) {
+	js, tag, err := c.GetRawIfNoneMatch(urlpath, etag)
+	if err != nil {
+		return "", err
+	}
+	return tag, json.Unmarshal([]byte(js), value)
+}
+
+// QueryRaw gets the JSON of the value selected by the JSON path from the
+// latest revision of the urlpath. The path syntax is that of the
+// json_extract function of SQLite, e.g. $.a.b[0], and it may contain the
+// JSONPath wildcards * and ..
+func (c *Client) QueryRaw(urlpath string, jsonpath string) (string, error) {
+	js, err := c.getRaw(urlpath, url.Values{"select": {jsonpath}})
+	if err != nil {
+		return "", err
+	}
+	if len(js) == 0 {
+		return "", fmt.Errorf("No content in %s", urlpath)
+	}
+	return js[0], nil
+}
+
+// Query unmarshals the value selected by the JSON path from the latest
+// revision of the urlpath into value
+func (c *Client) Query(urlpath string, jsonpath string, value interface{}) error {
+	js, err := c.QueryRaw(urlpath, jsonpath)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(js), value)
+}
+
+func (c *Client) put(urlpath string, header http.Header, json []byte) (string, error) {
 	buf := bytes.NewBuffer(json)
-	_, err := c.doRequest("PUT", urlpath, buf)
+	resp, err := c.doRequest("PUT", urlpath, nil, header, buf)
+	if err != nil {
+		return "", err
+	}
+	return resp.Header.Get("ETag"), resp.Body.Close()
+}
+
+func (c *Client) PutRaw(urlpath string, json []byte) error {
+	_, err := c.put(urlpath, nil, json)
 	return err
 }
 
+// PutRawIfMatch stores the JSON to the urlpath if the entity tag of its
+// latest revision matches etag. Returns ErrPreconditionFailed if it does
+// not match. Returns the entity tag of the new revision.
+func (c *Client) PutRawIfMatch(urlpath string, json []byte, etag string) (string, error) {
+	return c.put(urlpath, http.Header{"If-Match": {etag}}, json)
+}
+
+// PutIfMatch is PutRawIfMatch with the data marshalled to JSON
+func (c *Client) PutIfMatch(urlpath string, data interface{}, etag string) (string, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+
+	return c.PutRawIfMatch(urlpath, b, etag)
+}
+
+// CreateRaw stores the JSON to the urlpath only if the path has no
+// content. Returns ErrPreconditionFailed if it has. Returns the entity tag
+// of the new revision.
+func (c *Client) CreateRaw(urlpath string, json []byte) (string, error) {
+	return c.put(urlpath, http.Header{"If-None-Match": {"*"}}, json)
+}
+
+// Create is CreateRaw with the data marshalled to JSON
+func (c *Client) Create(urlpath string, data interface{}) (string, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+
+	return c.CreateRaw(urlpath, b)
+}
+
 func (c *Client) Put(urlpath string, data interface{}) error {
 	b, err := json.Marshal(data)
 	if err != nil {
@@ -155,7 +443,585 @@ func (c *Client) Put(urlpath string, data interface{}) error {
 	return c.PutRaw(urlpath, b)
 }
 
+func (c *Client) patch(urlpath, contentType string, body []byte) error {
+	header := http.Header{"Content-Type": {contentType}}
+	resp, err := c.doRequest("PATCH", urlpath, nil, header, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Patch applies the JSON Patch (RFC 6902) to the latest revision of the
+// urlpath
+func (c *Client) Patch(urlpath string, ops []PatchOp) error {
+	b, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+
+	return c.patch(urlpath, "application/json-patch+json", b)
+}
+
+// MergePatchRaw applies the JSON Merge Patch (RFC 7396) to the latest
+// revision of the urlpath
+func (c *Client) MergePatchRaw(urlpath string, json []byte) error {
+	return c.patch(urlpath, "application/merge-patch+json", json)
+}
+
+// MergePatch marshals the data and applies it as a JSON Merge Patch (RFC
+// 7396) to the latest revision of the urlpath
+func (c *Client) MergePatch(urlpath string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	return c.MergePatchRaw(urlpath, b)
+}
+
+func (c *Client) del(urlpath string, query url.Values, header http.Header) error {
+	resp, err := c.doRequest("DELETE", urlpath, query, header, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Delete removes the urlpath
 func (c *Client) Delete(urlpath string) error {
-	_, err := c.doRequest("DELETE", urlpath, nil)
-	return err
+	return c.del(urlpath, nil, nil)
+}
+
+// DeleteIfMatch removes the urlpath if the entity tag of its latest
+// revision matches etag. Returns ErrPreconditionFailed if it does not
+// match.
+func (c *Client) DeleteIfMatch(urlpath string, etag string) error {
+	return c.del(urlpath, nil, http.Header{"If-Match": {etag}})
+}
+
+// DeleteRecursive removes the urlpath and the paths below it
+func (c *Client) DeleteRecursive(urlpath string) error {
+	return c.del(urlpath, url.Values{"recursive": {""}}, nil)
+}
+
+// FindQuery selects the paths whose latest revision has a value matching
+// the predicate
+type FindQuery struct {
+	// Prefix limits the search to the prefix and the paths below it
+	Prefix string
+
+	// Field is the JSON path of the compared value, e.g. $.a.b[0]
+	Field string
+
+	// Op is one of exists, eq, ne, lt, le, gt and ge. If empty, eq is
+	// used if Value is set and exists otherwise.
+	Op string
+
+	// Value is marshalled to JSON and compared to the field. It should be
+	// a number, string, boolean or nil.
+	Value interface{}
+
+	// After is the cursor returned by the previous page
+	After string
+
+	// Limit is the maximum number of results. Zero uses the server
+	// default.
+	Limit int
+}
+
+// FindResult is the latest revision of a matching path with the value of
+// the field
+type FindResult struct {
+	Path  string
+	Id    int
+	Date  time.Time
+	Value json.RawMessage
+}
+
+// Find returns the paths matching the query and the cursor of the next
+// page, which is empty on the last page
+func (c *Client) Find(q FindQuery) ([]FindResult, string, error) {
+	query := url.Values{
+		"find":  {""},
+		"field": {q.Field},
+	}
+	if q.Prefix != "" {
+		query.Set("prefix", q.Prefix)
+	}
+	if q.Op != "" {
+		query.Set("op", q.Op)
+	}
+	if q.Value != nil || q.Op == "eq" || q.Op == "ne" {
+		b, err := json.Marshal(q.Value)
+		if err != nil {
+			return nil, "", err
+		}
+		query.Set("value", string(b))
+	}
+	if q.After != "" {
+		query.Set("after", q.After)
+	}
+	if q.Limit != 0 {
+		query.Set("limit", strconv.Itoa(q.Limit))
+	}
+
+	var ret struct {
+		Results []FindResult
+		Next    string
+	}
+	err := c.getData("/", query, &ret)
+	if err != nil {
+		return nil, "", err
+	}
+	return ret.Results, ret.Next, nil
+}
+
+// SearchResult is a path matching the full-text search. The Snippet is a
+// part of the indexed text escaped as HTML with the matches surrounded by
+// <mark> and </mark>.
+type SearchResult struct {
+	Path    string
+	Id      int
+	Score   float64
+	Snippet string
+}
+
+// Search finds the paths whose latest revision matches the full-text query
+// under the prefix, best first. The query uses the FTS5 syntax of SQLite.
+// At most limit results are returned starting from the offset. Zero limit
+// uses the server default. Returns also the offset of the next page, which
+// is zero on the last page.
+func (c *Client) Search(query string, prefix string, offset, limit int) ([]SearchResult, int, error) {
+	q := url.Values{"search": {query}}
+	if prefix != "" {
+		q.Set("prefix", prefix)
+	}
+	if offset != 0 {
+		q.Set("offset", strconv.Itoa(offset))
+	}
+	if limit != 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+
+	var ret struct {
+		Results []SearchResult
+		Next    int
+	}
+	err := c.getData("/", q, &ret)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ret.Results, ret.Next, nil
+}
+
+// PathInfo describes a stored path
+type PathInfo struct {
+	Path string
+
+	// Added is the time the oldest retained revision was added
+	Added time.Time
+
+	// Modified is the time the latest revision was added
+	Modified time.Time
+
+	// Revisions is the number of retained revisions
+	Revisions int
+
+	// Size is the length of the latest revision in bytes
+	Size int
+}
+
+// Info gets the information of the urlpath
+func (c *Client) Info(urlpath string) (*PathInfo, error) {
+	var ret PathInfo
+	err := c.getData(urlpath, url.Values{"info": {""}}, &ret)
+	if err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// TreeEntry is a child in a directory-style listing. A folder has paths
+// below it and a dump has content. If a name is both, it is listed as two
+// entries.
+type TreeEntry struct {
+	Name   string
+	Folder bool
+	Info   *PathInfo
+}
+
+// pager fetches the pages of a listing
+type pager struct {
+	c     *Client
+	query url.Values
+	next  string
+	done  bool
+	err   error
+}
+
+// fetch gets the next page into results. Returns false after the last
+// page or on failure.
+func (p *pager) fetch(results interface{}) bool {
+	if p.done {
+		return false
+	}
+
+	q := url.Values{}
+	for k, v := range p.query {
+		q[k] = v
+	}
+	if p.next != "" {
+		q.Set("after", p.next)
+	}
+
+	page := struct {
+		Results interface{}
+		Next    string
+	}{Results: results}
+	p.err = p.c.getData("/", q, &page)
+	if p.err != nil {
+		p.done = true
+		return false
+	}
+
+	p.next = page.Next
+	p.done = page.Next == ""
+	return true
+}
+
+// Err returns the error that stopped the paging
+func (p *pager) Err() error {
+	return p.err
+}
+
+func (c *Client) newPager(prefix string, pageSize int) pager {
+	q := url.Values{"prefix": {prefix}}
+	if pageSize > 0 {
+		q.Set("limit", strconv.Itoa(pageSize))
+	}
+	return pager{c: c, query: q}
+}
+
+// PathPages iterates over the pages of a path listing:
+//
+//	pages := c.ListPaths("builds", 100)
+//	for pages.Next() {
+//	    for _, p := range pages.Page() {
+//	        ...
+//	    }
+//	}
+//	if pages.Err() != nil {
+//	    ...
+//	}
+type PathPages struct {
+	pager
+	page []PathInfo
+}
+
+// ListPaths returns an iterator over the pages of the paths under the
+// prefix. The pageSize of zero uses the server default.
+func (c *Client) ListPaths(prefix string, pageSize int) *PathPages {
+	return &PathPages{pager: c.newPager(prefix, pageSize)}
+}
+
+// Next fetches the next page. Returns false when there are no more pages or
+// on failure.
+func (p *PathPages) Next() bool {
+	p.page = nil
+	return p.fetch(&p.page)
+}
+
+// Page returns the current page
+func (p *PathPages) Page() []PathInfo {
+	return p.page
+}
+
+// TreePages iterates over the pages of a directory-style listing the same
+// way as PathPages
+type TreePages struct {
+	pager
+	page []TreeEntry
+}
+
+// ListTree returns an iterator over the pages of the children of the
+// prefix. The paths are split into folders at the '/' characters. The
+// pageSize of zero uses the server default.
+func (c *Client) ListTree(prefix string, pageSize int) *TreePages {
+	p := c.newPager(prefix, pageSize)
+	p.query.Set("tree", "")
+	return &TreePages{pager: p}
+}
+
+// Next fetches the next page. Returns false when there are no more pages or
+// on failure.
+func (p *TreePages) Next() bool {
+	p.page = nil
+	return p.fetch(&p.page)
+}
+
+// Page returns the current page
+func (p *TreePages) Page() []TreeEntry {
+	return p.page
+}
+
+// Revision is a stored version of the data in a path
+type Revision struct {
+	Path string
+	Id   int
+	Date time.Time
+}
+
+// History lists the retained revisions of the urlpath, newest first
+func (c *Client) History(urlpath string) ([]Revision, error) {
+	var ret []Revision
+	err := c.getData(urlpath, url.Values{"history": {""}}, &ret)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// PatchOp is a single JSON Patch (RFC 6902) operation
+type PatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Diff returns the JSON Patch that transforms the revision from of the
+// urlpath into the revision to. If to is zero, the latest revision is used.
+// If from is zero, the revision preceding to is used.
+func (c *Client) Diff(urlpath string, from, to int) ([]PatchOp, error) {
+	q := url.Values{"diff": {""}}
+	if from != 0 {
+		q.Set("from", strconv.Itoa(from))
+	}
+	if to != 0 {
+		q.Set("to", strconv.Itoa(to))
+	}
+
+	var ret []PatchOp
+	err := c.getData(urlpath, q, &ret)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// GetVersionRaw gets the JSON of the revision id of urlpath
+func (c *Client) GetVersionRaw(urlpath string, id int) (string, error) {
+	var d []content
+	err := c.getData(urlpath, url.Values{"id": {strconv.Itoa(id)}}, &d)
+	if err != nil {
+		return "", err
+	}
+	if len(d) == 0 {
+		return "", fmt.Errorf("Revision %d of %s not found", id, urlpath)
+	}
+	return d[0].Text, nil
+}
+
+// GetVersion unmarshals the revision id of urlpath into value
+func (c *Client) GetVersion(urlpath string, id int, value interface{}) error {
+	js, err := c.GetVersionRaw(urlpath, id)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(js), value)
+}
+
+// probe GETs the endpoint at the root of the server. Returns the reason
+// given by the server if the response is not OK.
+func (c *Client) probe(endpoint string) error {
+	u := *c.Url
+	u.Path = path.Join(path.Dir(u.Path), endpoint)
+
+	var req *http.Request
+	var err error
+	if c.Ctx != nil {
+		req, err = http.NewRequestWithContext(c.Ctx, "GET", u.String(), nil)
+	} else {
+		req, err = http.NewRequest("GET", u.String(), nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.Http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var d struct {
+		Data string `json:"data"`
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &d)
+	}
+	if err != nil || d.Data == "" {
+		return fmt.Errorf("Received %d %s", resp.StatusCode, resp.Status)
+	}
+	return fmt.Errorf("Received %d %s: %s", resp.StatusCode, resp.Status, d.Data)
+}
+
+// Health checks that the server is alive
+func (c *Client) Health() error {
+	return c.probe("healthz")
+}
+
+// Ready checks that the server is ready to serve requests
+func (c *Client) Ready() error {
+	return c.probe("readyz")
+}
+
+// Event is a change of a path in the change feed
+type Event struct {
+	// Type is update or delete. It is reset if changes were missed and the
+	// watched paths should be read again.
+	Type string
+
+	Path string
+
+	// Id is the id of the updated revision
+	Id int
+
+	Date time.Time
+
+	// Recursive is set if the paths below the deleted path were deleted
+	Recursive bool
+
+	// Content is the updated revision if it was requested
+	Content json.RawMessage
+}
+
+// maxEventSize is the maximum length of a line of the change feed
+const maxEventSize = 64 * 1024 * 1024
+
+// readEvents sends the server-sent events of the stream to the channel
+// until the stream ends. Returns the id of the last event and the
+// reconnection delay given by the server.
+func readEvents(ctx context.Context, r io.Reader, events chan<- Event,
+	lastId string, retry time.Duration) (string, time.Duration) {
+
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, maxEventSize)
+
+	var id, typ string
+	var data []byte
+	for s.Scan() {
+		line := s.Text()
+		if line == "" {
+			var e Event
+			if typ != "" && json.Unmarshal(data, &e) == nil {
+				e.Type = typ
+				select {
+				case events <- e:
+				case <-ctx.Done():
+					return lastId, retry
+				}
+			}
+			if id != "" {
+				lastId = id
+			}
+			id, typ, data = "", "", nil
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "id":
+			id = value
+		case "event":
+			typ = value
+		case "data":
+			if data != nil {
+				data = append(data, '\n')
+			}
+			data = append(data, value...)
+		case "retry":
+			ms, err := strconv.Atoi(value)
+			if err == nil {
+				retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+	return lastId, retry
+}
+
+func (c *Client) watch(ctx context.Context, prefix string, content bool) (<-chan Event, error) {
+	q := url.Values{"watch": {""}, "prefix": {prefix}}
+	if content {
+		q.Set("content", "")
+	}
+
+	// The stream outlasts the timeout of the other requests
+	hc := *c.Http
+	hc.Timeout = 0
+	sc := *c
+	sc.Http = &hc
+	sc.Ctx = ctx
+
+	resp, err := sc.doRequest("GET", "/", q, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+
+		lastId := ""
+		retry := time.Second
+		for {
+			lastId, retry = readEvents(ctx, resp.Body, events, lastId, retry)
+			resp.Body.Close()
+
+			// Reconnect with an increasing delay until it succeeds
+			delay := retry
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(delay):
+				}
+
+				var header http.Header
+				if lastId != "" {
+					header = http.Header{"Last-Event-ID": {lastId}}
+				}
+				resp, err = sc.doRequest("GET", "/", q, header, nil)
+				if err == nil {
+					break
+				}
+				if delay < time.Minute {
+					delay *= 2
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// Watch returns the changes of the paths under the prefix until the context
+// is done. The connection is reopened if it is lost and the changes made in
+// between are received, or a reset event if they are no longer known.
+func (c *Client) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return c.watch(ctx, prefix, false)
+}
+
+// WatchContent is Watch with the content of the updated revisions
+func (c *Client) WatchContent(ctx context.Context, prefix string) (<-chan Event, error) {
+	return c.watch(ctx, prefix, true)
 }
@@ -1,10 +1,12 @@
 module github.com/kopoli/jsondump
 
-go 1.15
+go 1.20
 
 require (
 	github.com/davecgh/go-spew v1.1.1
+	github.com/gorilla/websocket v1.4.2
 	github.com/kopoli/appkit v0.11.1
-	github.com/mattn/go-sqlite3 v1.14.6
+	github.com/lib/pq v1.9.0
+	github.com/mattn/go-sqlite3 v1.14.15
 	github.com/pmezard/go-difflib v1.0.0
 )
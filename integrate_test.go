@@ -2,10 +2,24 @@ package main
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/kopoli/appkit"
@@ -14,14 +28,16 @@ import (
 	"github.com/pmezard/go-difflib/difflib"
 )
 
+var dumper = spew.ConfigState{Indent: " ", DisableCapacities: true}
+
 func structEquals(a, b interface{}) bool {
-	return spew.Sdump(a) == spew.Sdump(b)
+	return dumper.Sdump(a) == dumper.Sdump(b)
 }
 
 func diffStr(a, b interface{}) (ret string) {
 	diff := difflib.UnifiedDiff{
-		A:        difflib.SplitLines(spew.Sdump(a)),
-		B:        difflib.SplitLines(spew.Sdump(b)),
+		A:        difflib.SplitLines(dumper.Sdump(a)),
+		B:        difflib.SplitLines(dumper.Sdump(b)),
 		FromFile: "Expected",
 		ToFile:   "Received",
 		Context:  3,
@@ -73,6 +89,12 @@ func TestOperations(t *testing.T) {
 		}
 	}
 
+	delTree := func(path string) testFunc {
+		return func(s *state) error {
+			return s.Client.DeleteRecursive(path)
+		}
+	}
+
 	var failedOp int = -1
 
 	expectFailure := func() testFunc {
@@ -102,6 +124,16 @@ func TestOperations(t *testing.T) {
 		}
 	}
 
+	expectRawTree := func(path string, content ...string) testFunc {
+		return func(s *state) error {
+			d, err := s.Client.GetRawRecursive(path)
+			if err != nil {
+				return err
+			}
+			return compare(t, "content not equal", content, d)
+		}
+	}
+
 	put := func(path string, content interface{}) testFunc {
 		return func(s *state) error {
 			return s.Client.Put(path, content)
@@ -124,6 +156,276 @@ func TestOperations(t *testing.T) {
 		}
 	}
 
+	expectTree := func(path string, content ...testData) testFunc {
+		return func(s *state) error {
+			var v []testData
+			err := s.Client.GetRecursive(path, &v)
+			if err != nil {
+				return err
+			}
+			return compare(t, "content not equal", content, v)
+		}
+	}
+
+	setReplaceInterval := func(interval time.Duration) testFunc {
+		return func(s *state) error {
+			s.Db.Retention().ReplaceInterval = interval
+			return nil
+		}
+	}
+
+	expectHistory := func(path string, content ...string) testFunc {
+		return func(s *state) error {
+			revs, err := s.Client.History(path)
+			if err != nil {
+				return err
+			}
+
+			texts := make([]string, 0, len(revs))
+			for i := range revs {
+				text, err := s.Client.GetVersionRaw(path, revs[i].Id)
+				if err != nil {
+					return err
+				}
+				texts = append(texts, text)
+			}
+			return compare(t, "history not equal", content, texts)
+		}
+	}
+
+	expectVersion := func(path string, id int, content testData) testFunc {
+		return func(s *state) error {
+			var v testData
+			err := s.Client.GetVersion(path, id, &v)
+			if err != nil {
+				return err
+			}
+			return compare(t, "version not equal", content, v)
+		}
+	}
+
+	var marks = map[string]time.Time{}
+
+	mark := func(name string) testFunc {
+		return func(s *state) error {
+			marks[name] = time.Now()
+			// Make sure the following revisions are newer
+			time.Sleep(5 * time.Millisecond)
+			return nil
+		}
+	}
+
+	expectRawContentAt := func(path string, name string, content ...string) testFunc {
+		return func(s *state) error {
+			d, err := s.Client.GetRawAt(path, marks[name])
+			if err != nil {
+				return err
+			}
+			return compare(t, "content not equal", content, d)
+		}
+	}
+
+	expectTreeAt := func(path string, name string, content ...testData) testFunc {
+		return func(s *state) error {
+			var v []testData
+			err := s.Client.GetRecursiveAt(path, marks[name], &v)
+			if err != nil {
+				return err
+			}
+			return compare(t, "content not equal", content, v)
+		}
+	}
+
+	expectDiff := func(path string, from, to int, patch string) testFunc {
+		return func(s *state) error {
+			ops, err := s.Client.Diff(path, from, to)
+			if err != nil {
+				return err
+			}
+			b, err := json.Marshal(ops)
+			if err != nil {
+				return err
+			}
+			return compare(t, "diff not equal", patch, string(b))
+		}
+	}
+
+	patch := func(path string, ops string) testFunc {
+		return func(s *state) error {
+			var p []client.PatchOp
+			err := json.Unmarshal([]byte(ops), &p)
+			if err != nil {
+				return err
+			}
+			return s.Client.Patch(path, p)
+		}
+	}
+
+	mergePatch := func(path string, data interface{}) testFunc {
+		return func(s *state) error {
+			return s.Client.MergePatch(path, data)
+		}
+	}
+
+	mergePatchRaw := func(path string, content string) testFunc {
+		return func(s *state) error {
+			return s.Client.MergePatchRaw(path, []byte(content))
+		}
+	}
+
+	expectQuery := func(path string, jsonpath string, content string) testFunc {
+		return func(s *state) error {
+			js, err := s.Client.QueryRaw(path, jsonpath)
+			if err != nil {
+				return err
+			}
+			return compare(t, "selected content not equal", content, js)
+		}
+	}
+
+	expectFind := func(q client.FindQuery, next string, paths ...string) testFunc {
+		return func(s *state) error {
+			r, n, err := s.Client.Find(q)
+			if err != nil {
+				return err
+			}
+			got := make([]string, 0, len(r))
+			for i := range r {
+				got = append(got, r[i].Path+"="+string(r[i].Value))
+			}
+			err = compare(t, "found paths not equal", paths, got)
+			if err != nil {
+				return err
+			}
+			return compare(t, "next page not equal", next, n)
+		}
+	}
+
+	expectInfo := func(path string, revisions, size int) testFunc {
+		return func(s *state) error {
+			info, err := s.Client.Info(path)
+			if err != nil {
+				return err
+			}
+			if info.Added.After(info.Modified) {
+				return fmt.Errorf("Added %v after modified %v", info.Added, info.Modified)
+			}
+			return compare(t, "info not equal", []int{revisions, size},
+				[]int{info.Revisions, info.Size})
+		}
+	}
+
+	// expectPages expects the pages of paths joined with spaces
+	expectPages := func(prefix string, pageSize int, pages ...string) testFunc {
+		return func(s *state) error {
+			got := []string{}
+			it := s.Client.ListPaths(prefix, pageSize)
+			for it.Next() {
+				var names []string
+				for _, p := range it.Page() {
+					names = append(names, p.Path)
+				}
+				got = append(got, strings.Join(names, " "))
+			}
+			if it.Err() != nil {
+				return it.Err()
+			}
+			return compare(t, "pages not equal", pages, got)
+		}
+	}
+
+	// expectTreePages expects the pages of the tree joined with spaces.
+	// The folders are followed by a /.
+	expectTreePages := func(prefix string, pageSize int, pages ...string) testFunc {
+		return func(s *state) error {
+			got := []string{}
+			it := s.Client.ListTree(prefix, pageSize)
+			for it.Next() {
+				var names []string
+				for _, e := range it.Page() {
+					if e.Folder {
+						names = append(names, e.Name+"/")
+					} else {
+						names = append(names, fmt.Sprintf("%s:%d", e.Name, e.Info.Revisions))
+					}
+				}
+				got = append(got, strings.Join(names, " "))
+			}
+			if it.Err() != nil {
+				return it.Err()
+			}
+			return compare(t, "pages not equal", pages, got)
+		}
+	}
+
+	search := func(query string) testFunc {
+		return func(s *state) error {
+			_, _, err := s.Client.Search(query, "", 0, 0)
+			return err
+		}
+	}
+
+	var etags = map[string]string{"missing": `"1"`}
+
+	getEtag := func(path string, name string) testFunc {
+		return func(s *state) error {
+			_, tag, err := s.Client.GetRawIfNoneMatch(path, "")
+			etags[name] = tag
+			return err
+		}
+	}
+
+	expectModified := func(path string, name string, content string) testFunc {
+		return func(s *state) error {
+			js, _, err := s.Client.GetRawIfNoneMatch(path, etags[name])
+			if err != nil {
+				return err
+			}
+			return compare(t, "content not equal", content, js)
+		}
+	}
+
+	putIfMatch := func(path string, content string, name string) testFunc {
+		return func(s *state) error {
+			tag, err := s.Client.PutRawIfMatch(path, []byte(content), etags[name])
+			etags[name] = tag
+			return err
+		}
+	}
+
+	create := func(path string, content testData) testFunc {
+		return func(s *state) error {
+			_, err := s.Client.Create(path, content)
+			return err
+		}
+	}
+
+	delIfMatch := func(path string, name string) testFunc {
+		return func(s *state) error {
+			return s.Client.DeleteIfMatch(path, etags[name])
+		}
+	}
+
+	expectHealthy := func() testFunc {
+		return func(s *state) error {
+			err := s.Client.Health()
+			if err == nil {
+				err = s.Client.Ready()
+			}
+			return err
+		}
+	}
+
+	expectError := func(op testFunc, expected error) testFunc {
+		return func(s *state) error {
+			err := op(s)
+			if err != expected {
+				return compare(t, "error not expected", expected, err)
+			}
+			return nil
+		}
+	}
+
 	dbfile := "integrate_test.sqlite3"
 	opts := appkit.NewOptions()
 	ctx := context.TODO()
@@ -133,6 +435,9 @@ func TestOperations(t *testing.T) {
 		ops  []testOp
 	}{
 		{"No test operations", []testOp{}},
+		{"Health", []testOp{
+			expectHealthy(),
+		}},
 		{"Nothing put, get empty", []testOp{
 			expectRawContent("/abc", []string{}...),
 		}},
@@ -150,15 +455,23 @@ func TestOperations(t *testing.T) {
 			expectRawContent("/abc", `{"a":"b"}`),
 			expectRawContent("/cde", `{"c":"d"}`),
 		}},
+		{"Get all from the root", []testOp{
+			putRaw("/abc", `{"a":"b"   }`),
+			putRaw("/cde/f", `{"c":"d"   }`),
+			expectRawTree("/", `{"a":"b"}`, `{"c":"d"}`),
+		}},
 		{"Put hierarchy", []testOp{
 			putRaw("/abc/a", `{"a":"b"   }`),
 			putRaw("/abc/b", `{"c":"d"   }`),
-			expectRawContent("/abc", `{"a":"b"}`, `{"c":"d"}`),
+			putRaw("/abcd", `{"e":"f"   }`),
+			expectRawContent("/abc", []string{}...),
+			expectRawTree("/abc", `{"a":"b"}`, `{"c":"d"}`),
 		}},
 		{"Put overwrite", []testOp{
 			putRaw("/abc/a", `{"a":"b"   }`),
 			putRaw("/abc/a", `{"c":"d"   }`),
-			expectRawContent("/abc", `{"c":"d"}`),
+			expectRawContent("/abc/a", `{"c":"d"}`),
+			expectRawTree("/abc", `{"c":"d"}`),
 		}},
 		{"Put invalid json", []testOp{
 			putRaw("/abc", `{"contenthere":"firs`),
@@ -178,14 +491,23 @@ func TestOperations(t *testing.T) {
 		{"Delete hierarchy", []testOp{
 			putRaw("/abc/a", `{"a":"b"   }`),
 			putRaw("/abc/b", `{"c":"d"   }`),
-			del("/abc"),
-			expectRawContent("/abc", []string{}...),
+			putRaw("/abcd", `{"e":"f"   }`),
+			delTree("/abc"),
+			expectRawTree("/abc", []string{}...),
+			expectRawContent("/abcd", `{"e":"f"}`),
 		}},
 		{"Delete hierarchy partly", []testOp{
 			putRaw("/abc/a", `{"a":"b"   }`),
 			putRaw("/abc/b", `{"c":"d"   }`),
 			del("/abc/a"),
-			expectRawContent("/abc", `{"c":"d"}`),
+			expectRawTree("/abc", `{"c":"d"}`),
+		}},
+		{"Delete exact path", []testOp{
+			putRaw("/abc", `{"a":"b"   }`),
+			putRaw("/abc/b", `{"c":"d"   }`),
+			del("/abc"),
+			expectRawContent("/abc", []string{}...),
+			expectRawTree("/abc", `{"c":"d"}`),
 		}},
 		{"Put with marshalling", []testOp{
 			put("/abc", testData{A: 10, B: "smth"}),
@@ -194,9 +516,229 @@ func TestOperations(t *testing.T) {
 		{"Put with marshalling hierarchy", []testOp{
 			put("/abc/a", testData{A: 10, B: "smth"}),
 			put("/abc/b", testData{A: -1, B: "val"}),
-			expectContent("/abc", testData{A: 10, B: "smth"},
+			expectTree("/abc", testData{A: 10, B: "smth"},
 				testData{A: -1, B: "val"}),
 		}},
+		{"Get at time", []testOp{
+			setReplaceInterval(0),
+			mark("before"),
+			putRaw("/abc", `1`),
+			mark("first"),
+			putRaw("/abc", `2`),
+			mark("second"),
+			expectRawContentAt("/abc", "before", []string{}...),
+			expectRawContentAt("/abc", "first", `1`),
+			expectRawContentAt("/abc", "second", `2`),
+		}},
+		{"Get hierarchy at time", []testOp{
+			setReplaceInterval(0),
+			put("/abc/a", testData{A: 1, B: "a"}),
+			mark("first"),
+			put("/abc/a", testData{A: 2, B: "a"}),
+			put("/abc/b", testData{A: 3, B: "b"}),
+			mark("second"),
+			expectTreeAt("/abc", "first", testData{A: 1, B: "a"}),
+			expectTreeAt("/abc", "second", testData{A: 2, B: "a"},
+				testData{A: 3, B: "b"}),
+		}},
+		{"Diff latest revisions", []testOp{
+			setReplaceInterval(0),
+			putRaw("/abc", `{"a":1,"b":[1,2]}`),
+			putRaw("/abc", `{"a":2,"b":[1,2]}`),
+			putRaw("/abc", `{"a":2,"b":[1],"c":"d"}`),
+			expectDiff("/abc", 0, 0,
+				`[{"op":"remove","path":"/b/1"},{"op":"add","path":"/c","value":"d"}]`),
+			expectDiff("/abc", 0, 2,
+				`[{"op":"replace","path":"/a","value":2}]`),
+			expectDiff("/abc", 1, 0,
+				`[{"op":"replace","path":"/a","value":2},{"op":"remove","path":"/b/1"},{"op":"add","path":"/c","value":"d"}]`),
+			expectDiff("/abc", 3, 1,
+				`[{"op":"replace","path":"/a","value":1},{"op":"add","path":"/b/1","value":2},{"op":"remove","path":"/c"}]`),
+		}},
+		{"Diff without previous revision", []testOp{
+			putRaw("/abc", `{"a":1}`),
+			expectDiff("/abc", 0, 0, ``),
+			expectFailure(),
+		}},
+		{"Diff nonexistent revision", []testOp{
+			putRaw("/abc", `{"a":1}`),
+			expectDiff("/abc", 1, 5, ``),
+			expectFailure(),
+		}},
+		{"Patch", []testOp{
+			putRaw("/abc", `{"a":1,"b":[1,2]}`),
+			patch("/abc", `[{"op":"replace","path":"/a","value":2},{"op":"add","path":"/b/-","value":3}]`),
+			expectRawContent("/abc", `{"a":2,"b":[1,2,3]}`),
+		}},
+		{"Patch new path", []testOp{
+			patch("/abc", `[{"op":"add","path":"","value":{"a":1}}]`),
+			expectRawContent("/abc", `{"a":1}`),
+		}},
+		{"Patch failing test", []testOp{
+			putRaw("/abc", `{"a":1}`),
+			patch("/abc", `[{"op":"replace","path":"/a","value":2},{"op":"test","path":"/a","value":3}]`),
+			expectFailure(),
+			expectRawContent("/abc", `{"a":1}`),
+		}},
+		{"Merge patch", []testOp{
+			put("/abc", testData{A: 1, B: "first"}),
+			mergePatch("/abc", map[string]interface{}{"B": "second"}),
+			expectContent("/abc", testData{A: 1, B: "second"}),
+		}},
+		{"Merge patch removing members", []testOp{
+			putRaw("/abc", `{"a":1,"b":{"c":2,"d":3}}`),
+			mergePatchRaw("/abc", `{"a":null,"b":{"c":null,"e":4}}`),
+			expectRawContent("/abc", `{"b":{"d":3,"e":4}}`),
+		}},
+		{"Merge patch invalid json", []testOp{
+			putRaw("/abc", `{"a":1}`),
+			mergePatchRaw("/abc", `{"a":`),
+			expectFailure(),
+			expectRawContent("/abc", `{"a":1}`),
+		}},
+		{"Query", []testOp{
+			putRaw("/abc", `{"a":{"b":[1,2,3]},"c":"d"}`),
+			expectQuery("/abc", `$.a.b[1]`, `2`),
+			expectQuery("/abc", `$.a.b[#-1]`, `3`),
+			expectQuery("/abc", `$.c`, `"d"`),
+			expectQuery("/abc", `$.a.b[*]`, `[1,2,3]`),
+			expectQuery("/abc", `$.x`, `null`),
+		}},
+		{"Query with invalid path", []testOp{
+			putRaw("/abc", `{"a":1}`),
+			expectQuery("/abc", `a`, ``),
+			expectFailure(),
+		}},
+		{"Find", []testOp{
+			putRaw("/a", `{"state":"ok","n":1}`),
+			putRaw("/b", `{"state":"failed","n":2}`),
+			putRaw("/c/d", `{"state":"failed","n":3}`),
+			putRaw("/c/e", `{"state":"failed"}`),
+			expectFind(client.FindQuery{Field: "$.state", Value: "failed"}, "",
+				`b="failed"`, `c/d="failed"`, `c/e="failed"`),
+			expectFind(client.FindQuery{Field: "$.n", Op: "gt", Value: 1, Limit: 1}, "b",
+				`b=2`),
+			expectFind(client.FindQuery{Field: "$.n", Op: "gt", Value: 1, Limit: 1, After: "b"}, "",
+				`c/d=3`),
+			expectFind(client.FindQuery{Prefix: "c", Field: "$.n"}, "",
+				`c/d=3`),
+		}},
+		{"List paths in pages", []testOp{
+			putRaw("/a", `1`),
+			putRaw("/b/c", `1`),
+			putRaw("/b/d", `1`),
+			putRaw("/e", `1`),
+			expectPages("", 0, "a b/c b/d e"),
+			expectPages("", 3, "a b/c b/d", "e"),
+			expectPages("", 2, "a b/c", "b/d e"),
+			expectPages("b", 1, "b/c", "b/d"),
+		}},
+		{"Path information", []testOp{
+			setReplaceInterval(0),
+			putRaw("/abc", `{"a":1}`),
+			putRaw("/abc", `{"a":12}`),
+			expectInfo("/abc", 2, 8),
+		}},
+		{"Path information of empty path", []testOp{
+			expectInfo("/abc", 0, 0),
+			expectFailure(),
+		}},
+		{"List tree in pages", []testOp{
+			setReplaceInterval(0),
+			putRaw("/a", `1`),
+			putRaw("/a", `2`),
+			putRaw("/b/c", `1`),
+			putRaw("/b/d/e", `1`),
+			putRaw("/f", `1`),
+			expectTreePages("", 2, "a:2 b/", "f:1"),
+			expectTreePages("b", 0, "c:1 d/"),
+		}},
+		{"Search without index", []testOp{
+			putRaw("/a", `{"msg":"disk full"}`),
+			search("full"),
+			expectFailure(),
+		}},
+		{"Conditional get", []testOp{
+			putRaw("/abc", `1`),
+			getEtag("/abc", "first"),
+			expectError(expectModified("/abc", "first", ``), client.ErrNotModified),
+			setReplaceInterval(0),
+			putRaw("/abc", `2`),
+			expectModified("/abc", "first", `2`),
+		}},
+		{"Conditional get with replace interval", []testOp{
+			putRaw("/abc", `1`),
+			getEtag("/abc", "first"),
+			putRaw("/abc", `2`),
+			expectModified("/abc", "first", `2`),
+		}},
+		{"Conditional put", []testOp{
+			putRaw("/abc", `1`),
+			getEtag("/abc", "tag"),
+			putIfMatch("/abc", `2`, "tag"),
+			putIfMatch("/abc", `3`, "tag"),
+			expectRawContent("/abc", `3`),
+		}},
+		{"Conditional put with stale tag", []testOp{
+			putRaw("/abc", `1`),
+			getEtag("/abc", "tag"),
+			putRaw("/abc", `2`),
+			expectError(putIfMatch("/abc", `3`, "tag"), client.ErrPreconditionFailed),
+			expectRawContent("/abc", `2`),
+		}},
+		{"Conditional put to empty path", []testOp{
+			expectError(putIfMatch("/abc", `1`, "missing"), client.ErrPreconditionFailed),
+			expectRawContent("/abc", []string{}...),
+		}},
+		{"Create only", []testOp{
+			create("/abc", testData{A: 1, B: "first"}),
+			expectError(create("/abc", testData{A: 2, B: "second"}),
+				client.ErrPreconditionFailed),
+			expectContent("/abc", testData{A: 1, B: "first"}),
+		}},
+		{"Conditional delete", []testOp{
+			putRaw("/abc", `1`),
+			getEtag("/abc", "tag"),
+			setReplaceInterval(0),
+			putRaw("/abc", `2`),
+			expectError(delIfMatch("/abc", "tag"), client.ErrPreconditionFailed),
+			getEtag("/abc", "tag"),
+			delIfMatch("/abc", "tag"),
+			expectRawContent("/abc", []string{}...),
+		}},
+		{"History of empty path", []testOp{
+			expectHistory("/abc", []string{}...),
+		}},
+		{"History with replace interval", []testOp{
+			putRaw("/abc", `1`),
+			putRaw("/abc", `2`),
+			expectHistory("/abc", `2`),
+		}},
+		{"History of multiple revisions", []testOp{
+			setReplaceInterval(0),
+			putRaw("/abc", `1`),
+			putRaw("/abc", `2`),
+			putRaw("/abc", `3`),
+			putRaw("/abcd", `4`),
+			expectHistory("/abc", `3`, `2`, `1`),
+		}},
+		{"Get version", []testOp{
+			setReplaceInterval(0),
+			put("/abc", testData{A: 1, B: "first"}),
+			put("/abc", testData{A: 2, B: "second"}),
+			expectVersion("/abc", 1, testData{A: 1, B: "first"}),
+			expectVersion("/abc", 2, testData{A: 2, B: "second"}),
+		}},
+		{"Get nonexistent version", []testOp{
+			put("/abc", testData{A: 1, B: "first"}),
+			expectVersion("/abc", 2, testData{}),
+			expectFailure(),
+		}},
+		{"Get version of another path", []testOp{
+			put("/abc", testData{A: 1, B: "first"}),
+			expectVersion("/other", 1, testData{}),
+			expectFailure(),
+		}},
 	}
 	for _, tt := range tests {
 		_ = os.Remove(dbfile)
@@ -255,3 +797,355 @@ func TestOperations(t *testing.T) {
 	}
 
 }
+
+func TestAuth(t *testing.T) {
+	dbfile := "integrate_test.sqlite3"
+	_ = os.Remove(dbfile)
+	db, err := jsondump.CreateDb(dbfile, context.TODO())
+	if err != nil {
+		t.Fatalf("Setting up db failed with error = %v", err)
+	}
+	defer db.Close()
+
+	admin, _, err := jsondump.CreateToken(db, "admin", "", "rwd")
+	if err == nil {
+		err = db.Add("b/x", `"b"`)
+	}
+	if err != nil {
+		t.Fatalf("Setting up tokens failed with error = %v", err)
+	}
+	writer, _, err := jsondump.CreateToken(db, "writer", "a", "rw")
+	if err != nil {
+		t.Fatalf("Setting up tokens failed with error = %v", err)
+	}
+
+	opts := appkit.NewOptions()
+	opts.Set("auth", "t")
+	srv := httptest.NewServer(jsondump.CreateHandler(db, opts))
+	defer srv.Close()
+
+	expectStatus := func(err error, status string) {
+		t.Helper()
+		switch {
+		case status == "" && err != nil:
+			t.Errorf("Unexpected error = %v", err)
+		case status != "" && (err == nil || !strings.Contains(err.Error(), status)):
+			t.Errorf("Expected status %s, got error = %v", status, err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		op    func(c *client.Client) error
+		want  string
+	}{
+		{"No token", "", func(c *client.Client) error {
+			_, err := c.GetRaw("a/x")
+			return err
+		}, "401"},
+		{"Invalid token", "wrong", func(c *client.Client) error {
+			_, err := c.GetRaw("a/x")
+			return err
+		}, "401"},
+		{"Write under prefix", writer, func(c *client.Client) error {
+			return c.PutRaw("a/x", []byte(`"a"`))
+		}, ""},
+		{"Read under prefix", writer, func(c *client.Client) error {
+			_, err := c.GetRaw("a/x")
+			return err
+		}, ""},
+		{"Read outside prefix", writer, func(c *client.Client) error {
+			_, err := c.GetRaw("b/x")
+			return err
+		}, "403"},
+		{"List outside prefix", writer, func(c *client.Client) error {
+			p := c.ListPaths("", 0)
+			for p.Next() {
+			}
+			return p.Err()
+		}, "403"},
+		{"Delete without permission", writer, func(c *client.Client) error {
+			return c.Delete("a/x")
+		}, "403"},
+		{"Delete with permission", admin, func(c *client.Client) error {
+			return c.Delete("a/x")
+		}, ""},
+		{"Global token", admin, func(c *client.Client) error {
+			_, err := c.GetRaw("b/x")
+			return err
+		}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			copts := appkit.NewOptions()
+			if tt.token != "" {
+				copts.Set("token", tt.token)
+			}
+			cl, err := client.NewClient(srv.URL, copts)
+			if err != nil {
+				t.Fatalf("Creating client failed with error = %v", err)
+			}
+			cl.Http = srv.Client()
+
+			expectStatus(tt.op(cl), tt.want)
+		})
+	}
+}
+
+// testCert is a generated certificate and its PEM files
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// createCert generates a certificate with the common name to the dir. The
+// certificate is signed by the ca or self-signed if ca is nil.
+func createCert(t *testing.T, dir, name string, ca *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Generating key failed with error = %v", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("Generating serial failed with error = %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth,
+		},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	parent, parentKey := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, parentKey = ca.cert, ca.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err == nil {
+		tmpl, err = x509.ParseCertificate(der)
+	}
+	if err != nil {
+		t.Fatalf("Creating certificate failed with error = %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Encoding key failed with error = %v", err)
+	}
+
+	ret := &testCert{
+		cert:     tmpl,
+		key:      key,
+		certFile: filepath.Join(dir, name+".crt"),
+		keyFile:  filepath.Join(dir, name+".key"),
+	}
+	err = ioutil.WriteFile(ret.certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err == nil {
+		err = ioutil.WriteFile(ret.keyFile,
+			pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	}
+	if err != nil {
+		t.Fatalf("Writing certificate failed with error = %v", err)
+	}
+	return ret
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := createCert(t, dir, "ca", nil)
+	server := createCert(t, dir, "server", ca)
+	ci := createCert(t, dir, "ci", ca)
+	other := createCert(t, dir, "other", ca)
+	untrusted := createCert(t, dir, "untrusted", nil)
+
+	perms := filepath.Join(dir, "permissions.json")
+	err := ioutil.WriteFile(perms,
+		[]byte(`[{"subject": "ci", "prefix": "builds", "permissions": "rw"}]`), 0600)
+	if err != nil {
+		t.Fatalf("Writing permissions failed with error = %v", err)
+	}
+
+	dbfile := "integrate_test.sqlite3"
+	_ = os.Remove(dbfile)
+	db, err := jsondump.CreateDb(dbfile, context.TODO())
+	if err != nil {
+		t.Fatalf("Setting up db failed with error = %v", err)
+	}
+	defer db.Close()
+
+	opts := appkit.NewOptions()
+	opts.Set("tls-cert", server.certFile)
+	opts.Set("tls-key", server.keyFile)
+	opts.Set("tls-client-ca", ca.certFile)
+	opts.Set("tls-client-permissions", perms)
+
+	tlsConf, err := jsondump.ServerTLSConfig(opts)
+	if err != nil {
+		t.Fatalf("ServerTLSConfig() failed with error = %v", err)
+	}
+	_ = compare(t, "Client certificates not required",
+		tls.RequireAndVerifyClientCert, tlsConf.ClientAuth)
+
+	srv := httptest.NewUnstartedServer(jsondump.CreateHandler(db, opts))
+	srv.TLS = tlsConf
+	srv.StartTLS()
+	defer srv.Close()
+
+	newClient := func(cert *testCert) *client.Client {
+		t.Helper()
+		copts := appkit.NewOptions()
+		copts.Set("tls-ca", ca.certFile)
+		if cert != nil {
+			copts.Set("tls-cert", cert.certFile)
+			copts.Set("tls-key", cert.keyFile)
+		}
+		cl, err := client.NewClient(srv.URL, copts)
+		if err != nil {
+			t.Fatalf("Creating client failed with error = %v", err)
+		}
+		return cl
+	}
+
+	tests := []struct {
+		name    string
+		cert    *testCert
+		op      func(c *client.Client) error
+		wantErr string
+	}{
+		{"Write under prefix", ci, func(c *client.Client) error {
+			return c.PutRaw("builds/a", []byte(`"a"`))
+		}, ""},
+		{"Read under prefix", ci, func(c *client.Client) error {
+			d, err := c.GetRaw("builds/a")
+			if err == nil {
+				_ = compare(t, "content not equal", []string{`"a"`}, d)
+			}
+			return err
+		}, ""},
+		{"Write outside prefix", ci, func(c *client.Client) error {
+			return c.PutRaw("other/a", []byte(`"a"`))
+		}, "403"},
+		{"Delete without permission", ci, func(c *client.Client) error {
+			return c.Delete("builds/a")
+		}, "403"},
+		{"Subject without permissions", other, func(c *client.Client) error {
+			_, err := c.GetRaw("builds/a")
+			return err
+		}, "403"},
+		{"Untrusted certificate", untrusted, func(c *client.Client) error {
+			_, err := c.GetRaw("builds/a")
+			return err
+		}, "certificate"},
+		{"No certificate", nil, func(c *client.Client) error {
+			_, err := c.GetRaw("builds/a")
+			return err
+		}, "certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.op(newClient(tt.cert))
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Unexpected error = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Expected error with %q, got error = %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dbfile := "integrate_test.sqlite3"
+	_ = os.Remove(dbfile)
+	db, err := jsondump.CreateDb(dbfile, context.TODO())
+	if err != nil {
+		t.Fatalf("Setting up db failed with error = %v", err)
+	}
+	defer db.Close()
+
+	srv := httptest.NewServer(jsondump.CreateHandler(db, appkit.NewOptions()))
+	defer srv.Close()
+
+	c, err := client.NewClient(srv.URL, appkit.NewOptions())
+	if err != nil {
+		t.Fatalf("Creating client failed with error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := c.WatchContent(ctx, "a")
+	if err != nil {
+		t.Fatalf("Watch failed with error = %v", err)
+	}
+
+	expectEvent := func(want client.Event) {
+		t.Helper()
+		select {
+		case e := <-events:
+			if e.Date.IsZero() {
+				t.Errorf("Event of %s has no date", e.Path)
+			}
+			e.Id = 0
+			e.Date = time.Time{}
+			_ = compare(t, "Event not expected", want, e)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for event of %s", want.Path)
+		}
+	}
+	expectNoError := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("Unexpected error = %v", err)
+		}
+	}
+
+	expectNoError(c.PutRaw("b/x", []byte(`"b"`)))
+	expectNoError(c.PutRaw("a/x", []byte(`{"a": 1}`)))
+	expectEvent(client.Event{Type: "update", Path: "a/x",
+		Content: json.RawMessage(`{"a":1}`)})
+
+	expectNoError(c.MergePatch("a/x", map[string]int{"b": 2}))
+	expectEvent(client.Event{Type: "update", Path: "a/x",
+		Content: json.RawMessage(`{"a":1,"b":2}`)})
+
+	// Deleting a path without content is not a change
+	expectNoError(c.Delete("a/none"))
+	expectNoError(c.DeleteRecursive("a"))
+	expectEvent(client.Event{Type: "delete", Path: "a", Recursive: true})
+
+	// The changes while reconnecting are replayed. The idle connections of
+	// the client are closed as well.
+	srv.CloseClientConnections()
+	c, err = client.NewClient(srv.URL, appkit.NewOptions())
+	expectNoError(err)
+	expectNoError(c.PutRaw("a/y", []byte(`"y"`)))
+	expectEvent(client.Event{Type: "update", Path: "a/y",
+		Content: json.RawMessage(`"y"`)})
+
+	cancel()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Errorf("Expected the events to end")
+		}
+	case <-time.After(10 * time.Second):
+		t.Errorf("Timed out waiting for the events to end")
+	}
+}
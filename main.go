@@ -5,9 +5,12 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/kopoli/appkit"
+	"github.com/kopoli/jsondump/client"
 	jsondump "github.com/kopoli/jsondump/server"
 )
 
@@ -41,10 +44,53 @@ func main() {
 	optVerbose := base.Flags.Bool("verbose", false, "Enable verbose output")
 	optVersion := base.Flags.Bool("version", false, "Display version")
 	optDbPath := base.Flags.String("db-path", dbpath, "Database path")
+	optBackend := base.Flags.String("backend", "sqlite",
+		"Storage backend: "+strings.Join(jsondump.Backends, ", "))
+	optMaxVersions := base.Flags.Int("max-versions", 10, "Maximum number of revisions kept per path")
+	optReplaceInterval := base.Flags.Duration("replace-interval", 24*time.Hour,
+		"Time in which a new revision replaces the previous one")
+	optRetention := base.Flags.String("retention", "", "JSON file of retention rules for path prefixes")
+	optPostgresDsn := base.Flags.String("postgres-dsn", os.Getenv("JSONDUMP_POSTGRES_DSN"),
+		"PostgreSQL connection string of the postgres backend")
 
 	web := appkit.NewCommand(base, "start-web web", "Start web server")
 	optAddr := web.Flags.String("address", ":8032", "Listen address and port")
-	optTimestampLog := web.Flags.Bool("log-timestamps", false, "Write timestamps to log")
+	optAdminAddr := web.Flags.String("admin-address", "",
+		"Listen address of the profiling endpoints. Empty disables")
+	optTimestampLog := web.Flags.Bool("log-timestamps", false, "Write timestamps to the text log")
+	optLogLevel := web.Flags.String("log-level", "info", "Minimum level of the logged messages: debug, info, warn or error")
+	optLogFormat := web.Flags.String("log-format", "text", "Format of the log: text or json lines")
+	optCompactInterval := web.Flags.Duration("compact-interval", time.Hour,
+		"Interval of applying the retention rules to all paths. Zero disables")
+	optShutdownTimeout := web.Flags.Duration("shutdown-timeout", 30*time.Second,
+		"Time to wait for the requests to finish when stopping")
+	optAuth := web.Flags.Bool("auth", false, "Require an API token in the requests")
+	optTlsCert := web.Flags.String("tls-cert", "", "Certificate file for serving HTTPS")
+	optTlsKey := web.Flags.String("tls-key", "", "Private key file of the certificate")
+	optTlsClientCa := web.Flags.String("tls-client-ca", "",
+		"CA bundle for verifying client certificates. Enables client certificate authentication")
+	optTlsClientPerms := web.Flags.String("tls-client-permissions", "",
+		"JSON file of the permissions of the client certificate subjects. Empty allows all")
+
+	index := appkit.NewCommand(base, "rebuild-index", "Rebuild the full-text search index of the sqlite backend")
+	optDropIndex := index.Flags.Bool("drop", false, "Remove the index instead")
+
+	tokenCreate := appkit.NewCommand(base, "token-create", "Create an API token and print its secret")
+	optTokenName := tokenCreate.Flags.String("name", "", "Description of the token")
+	optTokenPrefix := tokenCreate.Flags.String("prefix", "", "Path prefix the token is limited to. Empty allows all paths")
+	optTokenPerms := tokenCreate.Flags.String("permissions", "r",
+		"Permissions of the token: r (read), w (write) and d (delete)")
+
+	tokenRevoke := appkit.NewCommand(base, "token-revoke", "Remove an API token")
+	optTokenId := tokenRevoke.Flags.Int("id", 0, "Id of the token")
+
+	_ = appkit.NewCommand(base, "token-list", "List the API tokens")
+
+	health := appkit.NewCommand(base, "health", "Check that a web server is alive and ready")
+	optHealthUrl := health.Flags.String("url", "http://localhost:8032", "URL of the web server")
+	optHealthCa := health.Flags.String("tls-ca", "", "CA bundle for verifying the server certificate")
+	optHealthCert := health.Flags.String("tls-cert", "", "Client certificate file")
+	optHealthKey := health.Flags.String("tls-key", "", "Private key file of the client certificate")
 
 	err = base.Parse(os.Args[1:], opts)
 	if err == flag.ErrHelp {
@@ -61,27 +107,136 @@ func main() {
 		os.Exit(0)
 	}
 
-	dbpath = *optDbPath
-	err = os.MkdirAll(dbpath, 0755)
-	checkErr(err)
-
 	cmd := opts.Get("cmdline-command", "")
 
+	// The health checks do not use the database
+	if cmd == "health" {
+		for name, value := range map[string]string{
+			"tls-ca":   *optHealthCa,
+			"tls-cert": *optHealthCert,
+			"tls-key":  *optHealthKey,
+		} {
+			if value != "" {
+				opts.Set(name, value)
+			}
+		}
+		cl, err := client.NewClient(*optHealthUrl, opts)
+		checkErr(err)
+		checkErr(cl.Health())
+		fmt.Println("alive")
+		checkErr(cl.Ready())
+		fmt.Println("ready")
+		return
+	}
+
+	// Zero revisions would remove also the one just written
+	if *optMaxVersions < 1 {
+		checkErr(fmt.Errorf("The max-versions must be positive"))
+	}
+
+	dbpath = *optDbPath
+	switch *optBackend {
+	case "postgres":
+		dbpath = *optPostgresDsn
+	case "sqlite", "file":
+		err = os.MkdirAll(dbpath, 0755)
+		checkErr(err)
+	}
+
 	ctx := context.Background()
 
-	dbpath = filepath.Join(dbpath, "jsondump.sqlite3")
-	db, err := jsondump.CreateDb(dbpath, ctx)
+	db, err := jsondump.OpenStore(*optBackend, dbpath, ctx)
 	checkErr(err)
-	defer db.Close()
+	closed := false
+	defer func() {
+		if !closed {
+			db.Close()
+		}
+	}()
+
+	retention := db.Retention()
+	retention.MaxVersions = *optMaxVersions
+	retention.ReplaceInterval = *optReplaceInterval
+
+	if *optRetention != "" {
+		rules, err := jsondump.LoadRetention(*optRetention, jsondump.Retention{
+			MaxVersions:     retention.MaxVersions,
+			ReplaceInterval: retention.ReplaceInterval,
+		})
+		checkErr(err)
+		retention.SetRules(rules)
+	}
 
 	switch cmd {
 	case "start-web":
 		opts.Set("address", *optAddr)
+		opts.Set("log-level", *optLogLevel)
+		opts.Set("log-format", *optLogFormat)
 		if *optTimestampLog {
 			opts.Set("log-timestamps", "t")
 		}
+		opts.Set("compact-interval", optCompactInterval.String())
+		opts.Set("shutdown-timeout", optShutdownTimeout.String())
+		if *optRetention != "" {
+			opts.Set("retention", *optRetention)
+		}
+		if *optAuth {
+			opts.Set("auth", "t")
+		}
+		for name, value := range map[string]string{
+			"admin-address":          *optAdminAddr,
+			"tls-cert":               *optTlsCert,
+			"tls-key":                *optTlsKey,
+			"tls-client-ca":          *optTlsClientCa,
+			"tls-client-permissions": *optTlsClientPerms,
+		} {
+			if value != "" {
+				opts.Set(name, value)
+			}
+		}
 		err = jsondump.StartWeb(db, opts)
+		cerr := db.Close()
+		closed = true
+		checkErr(err)
+		checkErr(cerr)
+		return
+	case "rebuild-index":
+		sqlite, ok := db.(*jsondump.Db)
+		if !ok {
+			checkErr(fmt.Errorf("The %s backend has no search index", *optBackend))
+		}
+		if *optDropIndex {
+			err = sqlite.DropSearchIndex()
+		} else {
+			err = sqlite.RebuildSearchIndex()
+		}
 		checkErr(err)
 		return
+	case "token-create":
+		secret, token, err := jsondump.CreateToken(db, *optTokenName, *optTokenPrefix, *optTokenPerms)
+		checkErr(err)
+		fmt.Fprintf(os.Stderr, "Created token %d. The secret is not shown again.\n", token.Id)
+		fmt.Println(secret)
+		return
+	case "token-revoke", "token-list":
+		ts, ok := db.(jsondump.TokenStore)
+		if !ok {
+			checkErr(fmt.Errorf("The %s backend does not support tokens", *optBackend))
+		}
+		if cmd == "token-revoke" {
+			checkErr(ts.RemoveToken(*optTokenId))
+			return
+		}
+
+		tokens, err := ts.GetTokens()
+		checkErr(err)
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tPREFIX\tPERMISSIONS\tCREATED")
+		for _, t := range tokens {
+			fmt.Fprintf(w, "%d\t%s\t/%s\t%s\t%s\n", t.Id, t.Name, t.Prefix,
+				t.Permissions, t.Created.Format(time.RFC3339))
+		}
+		checkErr(w.Flush())
+		return
 	}
 }
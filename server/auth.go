@@ -0,0 +1,309 @@
+package jsondump
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token is an API token that grants the Permissions to the paths under the
+// Prefix. The permissions are a combination of r (read), w (write) and d
+// (delete).
+type Token struct {
+	Id          int
+	Name        string
+	Prefix      string
+	Permissions string
+	Created     time.Time
+}
+
+// TokenStore is implemented by the stores that can keep API tokens. Only
+// the hashes of the token secrets are stored.
+type TokenStore interface {
+	// AddToken stores the token with the hash of its secret. Returns the
+	// id of the token.
+	AddToken(t *Token, hash string) (int, error)
+
+	// RemoveToken removes the token with the id
+	RemoveToken(id int) error
+
+	// GetTokens lists the tokens in the order of their ids
+	GetTokens() ([]Token, error)
+
+	// GetToken gets the token with the hash or nil if there is none
+	GetToken(hash string) (*Token, error)
+}
+
+// hashToken returns the stored hash of the token secret
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkPermissions verifies that the permissions consist of r, w and d
+func checkPermissions(perms string) error {
+	if perms == "" {
+		return fmt.Errorf("No permissions given")
+	}
+	for _, p := range perms {
+		if !strings.ContainsRune("rwd", p) {
+			return fmt.Errorf("Unknown permission %q, expected r, w or d", p)
+		}
+	}
+	return nil
+}
+
+// CreateToken creates a token to the store. Returns the secret of the
+// token, which is not stored.
+func CreateToken(s Store, name, prefix, perms string) (string, *Token, error) {
+	ts, ok := s.(TokenStore)
+	if !ok {
+		return "", nil, fmt.Errorf("The store does not support tokens")
+	}
+
+	err := checkPermissions(perms)
+	if err != nil {
+		return "", nil, err
+	}
+
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", nil, err
+	}
+	secret := hex.EncodeToString(b)
+
+	t := &Token{
+		Name:        name,
+		Prefix:      strings.Trim(prefix, "/"),
+		Permissions: perms,
+		Created:     time.Now(),
+	}
+	t.Id, err = ts.AddToken(t, hashToken(secret))
+	if err != nil {
+		return "", nil, err
+	}
+	return secret, t, nil
+}
+
+// allows returns true if the token has the permission to the path
+func (t *Token) allows(perm rune, path string) bool {
+	return strings.ContainsRune(t.Permissions, perm) && hasPathPrefix(path, t.Prefix)
+}
+
+// requiredPermission returns the permission the HTTP method needs
+func requiredPermission(method string) rune {
+	switch method {
+	case "GET", "HEAD":
+		return 'r'
+	case "DELETE":
+		return 'd'
+	}
+	return 'w'
+}
+
+type tokenContextKey struct{}
+
+// requestToken returns the token of the authenticated request or nil
+func requestToken(r *http.Request) *Token {
+	t, _ := r.Context().Value(tokenContextKey{}).(*Token)
+	return t
+}
+
+// authenticator holds the enabled ways of authenticating the requests
+type authenticator struct {
+	// bearer enables the tokens of the store. If the store cannot keep
+	// tokens, i.e. tokens is nil, all bearer tokens are rejected.
+	bearer bool
+	tokens TokenStore
+
+	// clientCerts enables the verified client certificates. If certs is
+	// nil, the certificates have all permissions.
+	clientCerts bool
+	certs       []CertPermission
+	certsMutex  sync.RWMutex
+}
+
+// loadCerts replaces the client certificate permissions with the ones in the
+// file. The permissions are kept if the file cannot be read.
+func (a *authenticator) loadCerts(filename string) error {
+	certs, err := LoadCertPermissions(filename)
+	if err != nil {
+		return err
+	}
+
+	a.certsMutex.Lock()
+	a.certs = certs
+	a.certsMutex.Unlock()
+	return nil
+}
+
+// authenticate returns the token of the request. Responds to the request
+// and returns nil if the request is not authenticated.
+func (a *authenticator) authenticate(w http.ResponseWriter, r *http.Request) *Token {
+	if a.clientCerts && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		a.certsMutex.RLock()
+		t := certToken(r.TLS.VerifiedChains[0][0], a.certs)
+		a.certsMutex.RUnlock()
+		if t == nil {
+			respond(w, "", fmt.Errorf("Certificate has no permissions"),
+				http.StatusForbidden)
+		}
+		return t
+	}
+
+	if !a.bearer {
+		respond(w, "", fmt.Errorf("Client certificate required"),
+			http.StatusUnauthorized)
+		return nil
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="jsondump"`)
+		respond(w, "", fmt.Errorf("Authentication required"),
+			http.StatusUnauthorized)
+		return nil
+	}
+
+	var t *Token
+	var err error
+	if a.tokens != nil {
+		t, err = a.tokens.GetToken(hashToken(strings.TrimPrefix(auth, "Bearer ")))
+	}
+	if err != nil {
+		respond(w, "", err, http.StatusInternalServerError)
+		return nil
+	}
+	if t == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="jsondump", error="invalid_token"`)
+		respond(w, "", fmt.Errorf("Invalid token"), http.StatusUnauthorized)
+	}
+	return t
+}
+
+// tokenHandler requires a bearer token or a client certificate and leaves
+// checking the permissions to the next handler
+func tokenHandler(a *authenticator) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t := a.authenticate(w, r)
+			if t == nil {
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), tokenContextKey{}, t)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// authHandler requires a bearer token or a client certificate with the
+// permission to the requested path. The path of the requests to the listing
+// of the API root is the prefix parameter. The requests outside the API
+// prefix need the permission to all paths.
+func authHandler(a *authenticator, apiPrefix string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t := a.authenticate(w, r)
+			if t == nil {
+				return
+			}
+
+			path := ""
+			escaped := r.URL.EscapedPath()
+			if strings.HasPrefix(escaped, apiPrefix) {
+				path = strings.Trim(strings.TrimPrefix(escaped, apiPrefix), "/")
+				if path == "" {
+					path = r.URL.Query().Get("prefix")
+				}
+			}
+
+			if !t.allows(requiredPermission(r.Method), path) {
+				respond(w, "", fmt.Errorf("Permission denied"), http.StatusForbidden)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), tokenContextKey{}, t)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func (db *Db) AddToken(t *Token, hash string) (int, error) {
+	var id int64
+	err := db.transaction(func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(db.ctx, `
+INSERT INTO token(name, hash, prefix, permissions, created)
+VALUES (@name, @hash, @prefix, @permissions, @created);`,
+			sql.Named("name", t.Name),
+			sql.Named("hash", hash),
+			sql.Named("prefix", t.Prefix),
+			sql.Named("permissions", t.Permissions),
+			sql.Named("created", t.Created),
+		)
+		if err != nil {
+			return err
+		}
+		id, err = res.LastInsertId()
+		return err
+	})
+	return int(id), err
+}
+
+func (db *Db) RemoveToken(id int) error {
+	return db.transaction(func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(db.ctx, `DELETE FROM token WHERE id = @id;`,
+			sql.Named("id", id))
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err == nil && n == 0 {
+			err = fmt.Errorf("Token %d not found", id)
+		}
+		return err
+	})
+}
+
+// getTokens runs the query that returns the token columns
+func (db *Db) getTokens(query string, args ...interface{}) ([]Token, error) {
+	ret := []Token{}
+	row := func(rows *sql.Rows) error {
+		var t Token
+		err := rows.Scan(&t.Id, &t.Name, &t.Prefix, &t.Permissions, &t.Created)
+		if err != nil {
+			return err
+		}
+		ret = append(ret, t)
+		return nil
+	}
+
+	err := db.query(query, row, args...)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (db *Db) GetTokens() ([]Token, error) {
+	return db.getTokens(`
+SELECT id, name, prefix, permissions, created FROM token ORDER BY id;`)
+}
+
+func (db *Db) GetToken(hash string) (*Token, error) {
+	t, err := db.getTokens(`
+SELECT id, name, prefix, permissions, created FROM token WHERE hash = @hash;`,
+		sql.Named("hash", hash))
+	if err != nil || len(t) == 0 {
+		return nil, err
+	}
+	return &t[0], nil
+}
@@ -0,0 +1,108 @@
+package jsondump
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestTokenAllows(t *testing.T) {
+	tok := &Token{Prefix: "a/b", Permissions: "rw"}
+	tests := []struct {
+		name string
+		perm rune
+		path string
+		want bool
+	}{
+		{"Prefix", 'r', "a/b", true},
+		{"Below prefix", 'w', "/a/b/c/", true},
+		{"Sibling", 'r', "a/bc", false},
+		{"Parent", 'r', "a", false},
+		{"Root", 'r', "", false},
+		{"No permission", 'd', "a/b", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tok.allows(tt.perm, tt.path)
+			_ = compare(t, "allows() not expected", tt.want, got)
+		})
+	}
+
+	global := &Token{Permissions: "r"}
+	_ = compare(t, "Empty prefix not allowed", true, global.allows('r', "x/y"))
+}
+
+func TestTokens(t *testing.T) {
+	_ = os.Remove(dbfile)
+	db, err := CreateDb(dbfile, context.TODO())
+	if err != nil {
+		t.Fatalf("Setting up db failed with error = %v", err)
+	}
+	defer db.Close()
+
+	_, _, err = CreateToken(db, "bad", "", "rx")
+	if err == nil {
+		t.Errorf("CreateToken() with unknown permission should fail")
+	}
+	_, _, err = CreateToken(NewMemStore(), "mem", "", "r")
+	if err == nil {
+		t.Errorf("CreateToken() to a store without tokens should fail")
+	}
+
+	secret, tok, err := CreateToken(db, "reader", "/a/", "r")
+	if err != nil {
+		t.Fatalf("CreateToken() failed with error = %v", err)
+	}
+	_ = compare(t, "Prefix not trimmed", "a", tok.Prefix)
+
+	got, err := db.GetToken(hashToken(secret))
+	if err != nil {
+		t.Fatalf("GetToken() failed with error = %v", err)
+	}
+	if got == nil {
+		t.Fatalf("GetToken() did not find the token")
+	}
+	_ = compare(t, "GetToken() not expected", []interface{}{tok.Id, "reader", "a", "r"},
+		[]interface{}{got.Id, got.Name, got.Prefix, got.Permissions})
+
+	got, err = db.GetToken(hashToken("wrong"))
+	if err != nil || got != nil {
+		t.Errorf("GetToken() of an unknown secret = %v, %v", got, err)
+	}
+
+	_, second, err := CreateToken(db, "writer", "", "rwd")
+	if err != nil {
+		t.Fatalf("CreateToken() failed with error = %v", err)
+	}
+
+	expectIds := func(ids ...int) {
+		t.Helper()
+		tokens, err := db.GetTokens()
+		if err != nil {
+			t.Fatalf("GetTokens() failed with error = %v", err)
+		}
+		got := []int{}
+		for i := range tokens {
+			got = append(got, tokens[i].Id)
+		}
+		_ = compare(t, "GetTokens() not expected", ids, got)
+	}
+
+	expectIds(tok.Id, second.Id)
+
+	err = db.RemoveToken(tok.Id)
+	if err != nil {
+		t.Fatalf("RemoveToken() failed with error = %v", err)
+	}
+	expectIds(second.Id)
+
+	err = db.RemoveToken(tok.Id)
+	if err == nil {
+		t.Errorf("RemoveToken() of a removed token should fail")
+	}
+
+	got, err = db.GetToken(hashToken(secret))
+	if err != nil || got != nil {
+		t.Errorf("GetToken() of a removed token = %v, %v", got, err)
+	}
+}
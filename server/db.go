@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -14,28 +15,18 @@ const (
 	replaceInterval = time.Hour * 24
 )
 
-const schema = `
-CREATE TABLE IF NOT EXISTS dump (
-  id INTEGER PRIMARY KEY ASC AUTOINCREMENT,
-  path TEXT DEFAULT "" NOT NULL UNIQUE ON CONFLICT ABORT
-);
-
-CREATE TABLE IF NOT EXISTS content (
-  id INTEGER PRIMARY KEY ASC AUTOINCREMENT,
-  text DEFAULT "" NOT NULL,
-  added DATETIME NOT NULL,
-  dumpid INTEGER REFERENCES dump(id) NOT NULL
-);
-
+const pragmas = `
 PRAGMA busy_timeout=10000;
-PRAGMA user_version=1;
 `
 
 type Db struct {
-	db              *sql.DB
-	ctx             context.Context
-	MaxVersions     int
-	ReplaceInterval time.Duration
+	db        *sql.DB
+	ctx       context.Context
+	now       func() time.Time
+	retention RetentionPolicy
+
+	// writable caches the readiness check of the database directory
+	writable writableCheck
 }
 
 type Content struct {
@@ -45,13 +36,19 @@ type Content struct {
 	Date time.Time
 }
 
+type Revision struct {
+	Path string
+	Id   int
+	Date time.Time
+}
+
 func CreateDb(path string, ctx context.Context) (*Db, error) {
 	d, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?cache=shared&mode=rwc", path))
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = d.ExecContext(ctx, schema)
+	_, err = d.ExecContext(ctx, pragmas)
 	if err != nil {
 		_ = d.Close()
 		return nil, err
@@ -60,39 +57,140 @@ func CreateDb(path string, ctx context.Context) (*Db, error) {
 	d.SetMaxOpenConns(1)
 
 	ret := &Db{
-		db:              d,
-		ctx:             ctx,
-		MaxVersions:     defaultVersions,
-		ReplaceInterval: replaceInterval,
+		db:  d,
+		ctx: ctx,
+		now: time.Now,
+		retention: RetentionPolicy{
+			MaxVersions:     defaultVersions,
+			ReplaceInterval: replaceInterval,
+		},
+	}
+
+	err = ret.migrate()
+	if err != nil {
+		_ = d.Close()
+		return nil, err
 	}
 
 	return ret, nil
 }
 
-func (db *Db) exec(queries []string, args ...interface{}) error {
+// transaction runs fn in a transaction. The transaction is rolled back if fn
+// fails.
+func (db *Db) transaction(fn func(tx *sql.Tx) error) error {
 	tx, err := db.db.BeginTx(db.ctx, nil)
 	if err != nil {
 		return err
 	}
 
+	err = fn(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *Db) execTx(tx *sql.Tx, queries []string, args ...interface{}) error {
 	for _, query := range queries {
-		_, err = tx.ExecContext(db.ctx, query,
+		_, err := tx.ExecContext(db.ctx, query,
 			args...,
 		)
 		if err != nil {
-			_ = tx.Rollback()
 			return err
 		}
 	}
-	err = tx.Commit()
-	if err != nil {
-		return err
-	}
 
 	return nil
 }
 
-func (db *Db) Add(path, content string) error {
+func (db *Db) exec(queries []string, args ...interface{}) error {
+	return db.transaction(func(tx *sql.Tx) error {
+		return db.execTx(tx, queries, args...)
+	})
+}
+
+func (db *Db) Retention() *RetentionPolicy {
+	return &db.retention
+}
+
+// trim removes the revisions of the path according to the retention policy.
+// Returns the number of removed revisions.
+func (db *Db) trim(tx *sql.Tx, path string, policy Retention, now time.Time) (int64, error) {
+	queries := []string{
+		`-- Remove the revisions of the path exceeding the maximum count
+DELETE FROM content
+WHERE content.id IN (
+  SELECT id FROM content
+  WHERE dumpid = (SELECT id FROM dump WHERE path = @path)
+  ORDER BY added DESC, id DESC
+  LIMIT -1 OFFSET @max);
+`,
+		`-- Remove the revisions older than the maximum age
+DELETE FROM content
+WHERE @maxage AND
+  content.dumpid = (SELECT id FROM dump WHERE path = @path) AND
+  strftime('%Y-%m-%d %H:%M:%f', content.added) < strftime('%Y-%m-%d %H:%M:%f', @oldest) AND
+  content.id != (
+    SELECT id FROM content
+    WHERE dumpid = (SELECT id FROM dump WHERE path = @path)
+    ORDER BY added DESC, id DESC LIMIT 1);
+`,
+		`-- Keep only the newest revision of each day of the older revisions
+DELETE FROM content
+WHERE @keepdaily AND
+  content.dumpid = (SELECT id FROM dump WHERE path = @path) AND
+  strftime('%Y-%m-%d %H:%M:%f', content.added) < strftime('%Y-%m-%d %H:%M:%f', @daily) AND
+  content.id NOT IN (
+    SELECT id FROM (
+      SELECT id, row_number() OVER (
+        PARTITION BY date(added) ORDER BY added DESC, id DESC) AS count
+      FROM content
+      WHERE dumpid = (SELECT id FROM dump WHERE path = @path))
+    WHERE count = 1);
+`,
+		`-- Remove the daily revisions that are too old
+DELETE FROM content
+WHERE @keepdaily AND
+  content.dumpid = (SELECT id FROM dump WHERE path = @path) AND
+  strftime('%Y-%m-%d %H:%M:%f', content.added) < strftime('%Y-%m-%d %H:%M:%f', @dailyoldest) AND
+  content.id != (
+    SELECT id FROM content
+    WHERE dumpid = (SELECT id FROM dump WHERE path = @path)
+    ORDER BY added DESC, id DESC LIMIT 1);
+`,
+	}
+
+	day := 24 * time.Hour
+	args := []interface{}{
+		sql.Named("path", path),
+		sql.Named("max", policy.MaxVersions),
+		sql.Named("maxage", policy.MaxAge > 0),
+		sql.Named("oldest", now.Add(-policy.MaxAge)),
+		sql.Named("keepdaily", policy.KeepDaily > 0),
+		sql.Named("daily", now.Add(-day)),
+		sql.Named("dailyoldest", now.Add(-time.Duration(policy.KeepDaily)*day)),
+	}
+
+	var ret int64
+	for _, query := range queries {
+		res, err := tx.ExecContext(db.ctx, query, args...)
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		ret += n
+	}
+
+	db.retention.countRemoved(ret)
+	return ret, nil
+}
+
+func (db *Db) add(tx *sql.Tx, path, content string) error {
 	queries := []string{
 		`-- Possibly insert a new path to the DB
 INSERT INTO dump(path)
@@ -110,39 +208,209 @@ INSERT INTO content(text, added, dumpid)
 SELECT @content AS text, @added AS added, dump.id
 FROM dump
 WHERE dump.path = @path;
-`,
-		`-- Remove excess elements from the content table
-DELETE FROM content
-WHERE content.dumpid = (SELECT id FROM dump WHERE path = @path) AND
-  content.id IN (SELECT id FROM content ORDER BY id DESC LIMIT -1 OFFSET @max);
 `,
 	}
 
-	added := time.Now()
-	replaceTime := added.Add(-db.ReplaceInterval)
+	policy := db.retention.lookup(path)
+	added := db.now()
+	replaceTime := added.Add(-policy.ReplaceInterval)
 
-	return db.exec(queries,
+	err := db.execTx(tx, queries,
 		sql.Named("path", path),
 		sql.Named("content", content),
 		sql.Named("added", added),
 		sql.Named("from", replaceTime),
-		sql.Named("max", db.MaxVersions),
 	)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.trim(tx, path, policy, added)
+	if err != nil {
+		return err
+	}
+
+	search, err := db.hasSearchIndex(tx)
+	if err == nil && search {
+		err = db.index(tx, path, content)
+	}
+	return err
 }
 
-func (db *Db) Delete(path string) error {
+// Compact applies the retention policies to all paths. Returns the number
+// of removed revisions.
+func (db *Db) Compact() (int64, error) {
+	paths, err := db.GetPaths()
+	if err != nil {
+		return 0, err
+	}
+
+	var ret int64
+	now := db.now()
+	for _, path := range paths {
+		policy := db.retention.lookup(path)
+		err = db.transaction(func(tx *sql.Tx) error {
+			n, err := db.trim(tx, path, policy, now)
+			ret += n
+			return err
+		})
+		if err != nil {
+			return ret, err
+		}
+	}
+
+	return ret, nil
+}
+
+func (db *Db) Add(path, content string) error {
+	return db.transaction(func(tx *sql.Tx) error {
+		return db.add(tx, path, content)
+	})
+}
+
+// latest returns the latest revision of the path or nil if the path has no
+// content.
+func (db *Db) latest(tx *sql.Tx, path string) (*Content, error) {
+	query := `
+SELECT content.id, content.text, content.added, dump.path
+FROM content, dump
+WHERE dump.path = @path AND dump.id = content.dumpid
+ORDER BY content.added DESC, content.id DESC
+LIMIT 1;
+`
+	var c Content
+	err := tx.QueryRowContext(db.ctx, query, sql.Named("path", path)).Scan(
+		&c.Id, &c.Text, &c.Date, &c.Path)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Update adds the content returned by fn as a new revision of the path. The
+// fn gets the latest revision of the path, or nil if there is none. The
+// read and the write are done in the same transaction. Returns the added
+// revision.
+func (db *Db) Update(path string, fn func(cur *Content) (string, error)) (*Content, error) {
+	var ret *Content
+	err := db.transaction(func(tx *sql.Tx) error {
+		cur, err := db.latest(tx, path)
+		if err != nil {
+			return err
+		}
+
+		content, err := fn(cur)
+		if err != nil {
+			return err
+		}
+
+		err = db.add(tx, path, content)
+		if err != nil {
+			return err
+		}
+
+		ret, err = db.latest(tx, path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// subtreePattern returns a LIKE pattern that matches the paths below the
+// given path. Paths are only matched on the '/' boundaries.
+func subtreePattern(path string) string {
+	if path == "" {
+		return "%"
+	}
+	return likeEscaper.Replace(path) + "/%"
+}
+
+// pathArgs returns the query arguments for matching the path and
+// optionally the paths below it.
+func pathArgs(path string, recursive bool) []interface{} {
+	if recursive {
+		path = strings.TrimSuffix(path, "/")
+	}
+	return []interface{}{
+		sql.Named("path", path),
+		sql.Named("recursive", recursive),
+		sql.Named("subtree", subtreePattern(path)),
+	}
+}
+
+// deletePaths removes the path and optionally the paths below it in the
+// transaction
+func (db *Db) deletePaths(tx *sql.Tx, path string, recursive bool) error {
 	queries := []string{
-		`-- Remove excess elements from the content table
+		`-- Remove the contents of the paths
 DELETE FROM content
-WHERE content.dumpid = (SELECT id FROM dump WHERE path LIKE @path);
+WHERE content.dumpid IN (
+  SELECT id FROM dump
+  WHERE path = @path OR (@recursive AND path LIKE @subtree ESCAPE '\'));
 `,
-		`-- Delete path prefix recursively
+		`-- Delete the paths
 DELETE FROM dump
-WHERE dump.path LIKE @path;
+WHERE path = @path OR (@recursive AND path LIKE @subtree ESCAPE '\');
 `}
-	return db.exec(queries,
-		sql.Named("path", path+"%"),
-	)
+	args := pathArgs(path, recursive)
+
+	search, err := db.hasSearchIndex(tx)
+	if err != nil {
+		return err
+	}
+	if search {
+		err = db.execTx(tx, []string{`-- Remove the paths from the search index
+DELETE FROM search
+WHERE rowid IN (
+  SELECT id FROM dump
+  WHERE path = @path OR (@recursive AND path LIKE @subtree ESCAPE '\'));
+`}, args...)
+		if err != nil {
+			return err
+		}
+	}
+	return db.execTx(tx, queries, args...)
+}
+
+// Delete removes the path. If recursive is set, removes also the paths below
+// it.
+func (db *Db) Delete(path string, recursive bool) error {
+	return db.transaction(func(tx *sql.Tx) error {
+		return db.deletePaths(tx, path, recursive)
+	})
+}
+
+// DeleteIf removes the path like Delete if fn returns no error. The fn gets
+// the latest revision of the path, or nil if there is none. The read and the
+// removal are done in the same transaction. Returns the latest revision
+// before the removal.
+func (db *Db) DeleteIf(path string, recursive bool, fn func(cur *Content) error) (*Content, error) {
+	var ret *Content
+	err := db.transaction(func(tx *sql.Tx) error {
+		var err error
+		ret, err = db.latest(tx, path)
+		if err != nil {
+			return err
+		}
+
+		err = fn(ret)
+		if err != nil {
+			return err
+		}
+
+		return db.deletePaths(tx, path, recursive)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
 }
 
 func (db *Db) query(query string, handleRow func(*sql.Rows) error,
@@ -152,6 +420,7 @@ func (db *Db) query(query string, handleRow func(*sql.Rows) error,
 	if err != nil {
 		return err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		err = handleRow(rows)
@@ -184,17 +453,72 @@ SELECT path FROM dump ORDER BY path ASC;
 	return ret, nil
 }
 
-func (db *Db) GetContent(path string, numLatest int) ([]Content, error) {
+func (db *Db) ListPaths(q *ListQuery) ([]PathInfo, error) {
+	query := `
+SELECT dump.path, first.added, latest.added,
+       (SELECT count(*) FROM content WHERE content.dumpid = dump.id),
+       length(CAST(latest.text AS BLOB))
+FROM (
+  -- The page of paths that have content
+  SELECT id, path FROM dump
+  WHERE (path = @path OR (@recursive AND path LIKE @subtree ESCAPE '\')) AND
+    path > @after AND
+    EXISTS (SELECT 1 FROM content WHERE content.dumpid = dump.id)
+  ORDER BY path
+  LIMIT @limit) AS dump,
+  content AS latest,
+  content AS first
+WHERE latest.id = (
+    SELECT id FROM content WHERE content.dumpid = dump.id
+    ORDER BY added DESC, id DESC LIMIT 1) AND
+  first.id = (
+    SELECT id FROM content WHERE content.dumpid = dump.id
+    ORDER BY added ASC, id ASC LIMIT 1)
+ORDER BY dump.path;
+`
+	ret := []PathInfo{}
+	row := func(rows *sql.Rows) error {
+		var p PathInfo
+		err := rows.Scan(&p.Path, &p.Added, &p.Modified, &p.Revisions, &p.Size)
+		if err != nil {
+			return err
+		}
+		ret = append(ret, p)
+		return nil
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+
+	args := append(pathArgs(q.Prefix, true),
+		sql.Named("after", q.After),
+		sql.Named("limit", limit),
+	)
+
+	err := db.query(query, row, args...)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// GetContent gets the numLatest revisions of the path. If numLatest is
+// negative, gets all revisions. If recursive is set, gets also the revisions
+// of the paths below it.
+func (db *Db) GetContent(path string, recursive bool, numLatest int) ([]Content, error) {
 	query := `
 SELECT * FROM (
   -- Add row numbers to the rows in groups partitioned by different paths
   SELECT content.id, content.text, content.added, dump.path,
-         row_number() OVER (PARTITION BY dump.path ORDER BY content.added DESC) AS count
+         row_number() OVER (PARTITION BY dump.path ORDER BY content.added DESC, content.id DESC) AS count
   FROM content, dump
-  WHERE dump.path LIKE @path AND dump.id = content.dumpid
-  ORDER BY dump.path, content.added DESC)
+  WHERE (dump.path = @path OR (@recursive AND dump.path LIKE @subtree ESCAPE '\')) AND
+    dump.id = content.dumpid
+  ORDER BY dump.path, content.added DESC, content.id DESC)
 -- if the row number is too high (i.e. too old version)
-WHERE count <= @limit;
+WHERE @limit < 0 OR count <= @limit;
 `
 	ret := []Content{}
 
@@ -209,13 +533,104 @@ WHERE count <= @limit;
 		return nil
 	}
 
-	if numLatest < 0 {
-		numLatest = db.MaxVersions
+	args := append(pathArgs(path, recursive),
+		sql.Named("limit", numLatest),
+	)
+
+	err := db.query(query, row, args...)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// GetContentAt gets the newest revision of the path that was added at or
+// before the given time. If recursive is set, gets also the revisions of the
+// paths below it.
+func (db *Db) GetContentAt(path string, recursive bool, at time.Time) ([]Content, error) {
+	query := `
+SELECT id, text, added, path FROM (
+  SELECT content.id, content.text, content.added, dump.path,
+         row_number() OVER (PARTITION BY dump.path ORDER BY content.added DESC, content.id DESC) AS count
+  FROM content, dump
+  WHERE (dump.path = @path OR (@recursive AND dump.path LIKE @subtree ESCAPE '\')) AND
+    dump.id = content.dumpid AND
+    strftime('%Y-%m-%d %H:%M:%f', content.added) <= strftime('%Y-%m-%d %H:%M:%f', @at)
+  ORDER BY dump.path, content.added DESC, content.id DESC)
+WHERE count = 1;
+`
+	ret := []Content{}
+
+	row := func(rows *sql.Rows) error {
+		var c Content
+		err := rows.Scan(&c.Id, &c.Text, &c.Date, &c.Path)
+		if err != nil {
+			return err
+		}
+		ret = append(ret, c)
+		return nil
+	}
+
+	args := append(pathArgs(path, recursive),
+		sql.Named("at", at),
+	)
+
+	err := db.query(query, row, args...)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (db *Db) GetHistory(path string) ([]Revision, error) {
+	query := `
+SELECT content.id, content.added, dump.path
+FROM content, dump
+WHERE dump.path = @path AND dump.id = content.dumpid
+ORDER BY content.added DESC, content.id DESC;
+`
+	ret := []Revision{}
+
+	row := func(rows *sql.Rows) error {
+		var r Revision
+		err := rows.Scan(&r.Id, &r.Date, &r.Path)
+		if err != nil {
+			return err
+		}
+		ret = append(ret, r)
+		return nil
 	}
 
 	err := db.query(query, row,
-		sql.Named("path", path+"%"),
-		sql.Named("limit", numLatest),
+		sql.Named("path", path),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (db *Db) GetRevision(path string, id int) ([]Content, error) {
+	query := `
+SELECT content.id, content.text, content.added, dump.path
+FROM content, dump
+WHERE dump.path = @path AND dump.id = content.dumpid AND content.id = @id;
+`
+	ret := []Content{}
+
+	row := func(rows *sql.Rows) error {
+		var c Content
+		err := rows.Scan(&c.Id, &c.Text, &c.Date, &c.Path)
+		if err != nil {
+			return err
+		}
+		ret = append(ret, c)
+		return nil
+	}
+
+	err := db.query(query, row,
+		sql.Named("path", path),
+		sql.Named("id", id),
 	)
 	if err != nil {
 		return nil, err
@@ -223,6 +638,20 @@ WHERE count <= @limit;
 	return ret, nil
 }
 
+func (db *Db) Size() (int64, error) {
+	var ret int64
+	err := db.db.QueryRowContext(db.ctx, `
+SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size();`).Scan(&ret)
+	return ret, err
+}
+
+func (db *Db) Count() (int64, int64, error) {
+	var paths, revisions int64
+	err := db.db.QueryRowContext(db.ctx, `
+SELECT COUNT(DISTINCT dumpid), COUNT(*) FROM content;`).Scan(&paths, &revisions)
+	return paths, revisions, err
+}
+
 func (db *Db) Close() error {
 	return db.db.Close()
 }
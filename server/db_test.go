@@ -2,8 +2,10 @@ package jsondump
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -13,14 +15,16 @@ import (
 
 // general testing functionality
 
+var dumper = spew.ConfigState{Indent: " ", DisableCapacities: true}
+
 func structEquals(a, b interface{}) bool {
-	return spew.Sdump(a) == spew.Sdump(b)
+	return dumper.Sdump(a) == dumper.Sdump(b)
 }
 
 func diffStr(a, b interface{}) (ret string) {
 	diff := difflib.UnifiedDiff{
-		A:        difflib.SplitLines(spew.Sdump(a)),
-		B:        difflib.SplitLines(spew.Sdump(b)),
+		A:        difflib.SplitLines(dumper.Sdump(a)),
+		B:        difflib.SplitLines(dumper.Sdump(b)),
 		FromFile: "Expected",
 		ToFile:   "Received",
 		Context:  3,
@@ -79,18 +83,63 @@ func TestCreateDb(t *testing.T) {
 }
 
 type testOp interface {
-	run(*Db) error
+	run(Store) error
 }
 
-type testFunc func(*Db) error
+type testFunc func(Store) error
 
-func (t testFunc) run(d *Db) error {
+func (t testFunc) run(d Store) error {
 	return t(d)
 }
 
+// setNow sets the clock of the store
+func setNow(s Store, now func() time.Time) {
+	switch st := s.(type) {
+	case *Db:
+		st.now = now
+	case *genericStore:
+		st.now = now
+	case *PgStore:
+		st.now = now
+	}
+}
+
+func TestDbIndexes(t *testing.T) {
+	_ = os.Remove(dbfile)
+	db, err := CreateDb(dbfile, context.TODO())
+	if err != nil {
+		t.Errorf("Setting up db failed with error = %v", err)
+		return
+	}
+	defer db.Close()
+
+	var plan []string
+	row := func(rows *sql.Rows) error {
+		var id, parent, notused int
+		var detail string
+		err := rows.Scan(&id, &parent, &notused, &detail)
+		plan = append(plan, detail)
+		return err
+	}
+
+	err = db.query(`EXPLAIN QUERY PLAN
+SELECT id FROM content WHERE dumpid = 1 ORDER BY added DESC, id DESC;`, row)
+	if err != nil {
+		t.Errorf("Explaining query failed with error = %v", err)
+		return
+	}
+
+	for _, detail := range plan {
+		if strings.Contains(detail, "content_dumpid_added") {
+			return
+		}
+	}
+	t.Errorf("Query does not use the content index: %v", plan)
+}
+
 func TestDb(t *testing.T) {
 	add := func(path string, content ...string) testFunc {
-		return func(d *Db) error {
+		return func(d Store) error {
 			for _, c := range content {
 				err := d.Add(path, c)
 				if err != nil {
@@ -101,15 +150,68 @@ func TestDb(t *testing.T) {
 		}
 	}
 
+	update := func(path string, content string) testFunc {
+		return func(d Store) error {
+			c, err := d.Update(path, func(cur *Content) (string, error) {
+				if cur == nil {
+					return content, nil
+				}
+				return cur.Text + content, nil
+			})
+			if err != nil {
+				return err
+			}
+			if c == nil || c.Path != path {
+				return fmt.Errorf("Update returned invalid revision %v", c)
+			}
+			return nil
+		}
+	}
+
+	failUpdate := func(path string) testFunc {
+		return func(d Store) error {
+			_, err := d.Update(path, func(cur *Content) (string, error) {
+				return "", fmt.Errorf("Update failed")
+			})
+			if err == nil {
+				return fmt.Errorf("Expected update to fail")
+			}
+			return nil
+		}
+	}
+
 	del := func(path string) testFunc {
-		return func(d *Db) error {
-			return d.Delete(path)
+		return func(d Store) error {
+			return d.Delete(path, false)
 		}
 	}
 
-	expectLatestContent := func(path string, content ...string) testFunc {
-		return func(d *Db) error {
-			c, err := d.GetContent(path, 1)
+	delTree := func(path string) testFunc {
+		return func(d Store) error {
+			return d.Delete(path, true)
+		}
+	}
+
+	// delIf deletes the path if the text of its latest revision is the
+	// given one
+	delIf := func(path string, recursive bool, text string) testFunc {
+		return func(d Store) error {
+			cur, err := d.DeleteIf(path, recursive, func(cur *Content) error {
+				if cur == nil || cur.Text != text {
+					return fmt.Errorf("Revision does not match")
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			return compare(t, "Deleted revision not expected", text, cur.Text)
+		}
+	}
+
+	latestContent := func(path string, recursive bool, content ...string) testFunc {
+		return func(d Store) error {
+			c, err := d.GetContent(path, recursive, 1)
 			if err != nil {
 				return err
 			}
@@ -123,23 +225,31 @@ func TestDb(t *testing.T) {
 		}
 	}
 
+	expectLatestContent := func(path string, content ...string) testFunc {
+		return latestContent(path, false, content...)
+	}
+
+	expectLatestTree := func(path string, content ...string) testFunc {
+		return latestContent(path, true, content...)
+	}
+
 	setReplaceInterval := func(interval time.Duration) testFunc {
-		return func(d *Db) error {
-			d.ReplaceInterval = interval
+		return func(d Store) error {
+			d.Retention().ReplaceInterval = interval
 			return nil
 		}
 	}
 
 	setMaxVersions := func(vers int) testFunc {
-		return func(d *Db) error {
-			d.MaxVersions = vers
+		return func(d Store) error {
+			d.Retention().MaxVersions = vers
 			return nil
 		}
 	}
 
-	expectContentVersions := func(path string, count int) testFunc {
-		return func(d *Db) error {
-			c, err := d.GetContent(path, -1)
+	contentVersions := func(path string, recursive bool, count int) testFunc {
+		return func(d Store) error {
+			c, err := d.GetContent(path, recursive, -1)
 			if err != nil {
 				return err
 			}
@@ -147,6 +257,197 @@ func TestDb(t *testing.T) {
 		}
 	}
 
+	expectContentVersions := func(path string, count int) testFunc {
+		return contentVersions(path, false, count)
+	}
+
+	expectTreeVersions := func(path string, count int) testFunc {
+		return contentVersions(path, true, count)
+	}
+
+	baseTime := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	// setTime sets the clock of the db to minutes after the baseTime
+	setTime := func(minutes int) testFunc {
+		return func(d Store) error {
+			setNow(d, func() time.Time {
+				return baseTime.Add(time.Duration(minutes) * time.Minute)
+			})
+			return nil
+		}
+	}
+
+	contentAt := func(path string, recursive bool, minutes int, content ...string) testFunc {
+		return func(d Store) error {
+			at := baseTime.Add(time.Duration(minutes) * time.Minute)
+			c, err := d.GetContentAt(path, recursive, at)
+			if err != nil {
+				return err
+			}
+
+			texts := make([]string, 0, len(c))
+			for i := range c {
+				texts = append(texts, c[i].Text)
+			}
+
+			return compare(t, "content not equal", texts, content)
+		}
+	}
+
+	expectContentAt := func(path string, minutes int, content ...string) testFunc {
+		return contentAt(path, false, minutes, content...)
+	}
+
+	expectTreeAt := func(path string, minutes int, content ...string) testFunc {
+		return contentAt(path, true, minutes, content...)
+	}
+
+	setRetention := func(rules ...Retention) testFunc {
+		return func(d Store) error {
+			d.Retention().SetRules(rules)
+			return nil
+		}
+	}
+
+	expectCompact := func(removed int64) testFunc {
+		return func(d Store) error {
+			n, err := d.Compact()
+			if err != nil {
+				return err
+			}
+			return compare(t, "Removed count inequal", n, removed)
+		}
+	}
+
+	// addInterleaved adds count revisions to each of the paths in turns
+	addInterleaved := func(count int, paths ...string) testFunc {
+		return func(d Store) error {
+			for i := 0; i < count; i++ {
+				for _, p := range paths {
+					err := d.Add(p, fmt.Sprintf("%s-%d", p, i))
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+	}
+
+	// expectList expects the listed paths as path:revisions strings
+	expectList := func(q ListQuery, paths ...string) testFunc {
+		return func(d Store) error {
+			infos, err := d.ListPaths(&q)
+			if err != nil {
+				return err
+			}
+
+			got := make([]string, 0, len(infos))
+			for i := range infos {
+				if !infos[i].Modified.Equal(baseTime) {
+					return fmt.Errorf("Modified time of %s is %v",
+						infos[i].Path, infos[i].Modified)
+				}
+				got = append(got, fmt.Sprintf("%s:%d", infos[i].Path, infos[i].Revisions))
+			}
+			return compare(t, "ListPaths not expected", paths, got)
+		}
+	}
+
+	// expectInfo expects the information of the path. The times are in
+	// minutes after the baseTime.
+	expectInfo := func(path string, added, modified, revisions, size int) testFunc {
+		return func(d Store) error {
+			info, err := GetPathInfo(d, path)
+			if err != nil {
+				return err
+			}
+			if info == nil {
+				return fmt.Errorf("No information for %s", path)
+			}
+
+			minutes := func(t time.Time) int {
+				return int(t.Sub(baseTime) / time.Minute)
+			}
+			return compare(t, "GetPathInfo not expected",
+				[]int{added, modified, revisions, size},
+				[]int{minutes(info.Added), minutes(info.Modified), info.Revisions, info.Size})
+		}
+	}
+
+	expectNoInfo := func(path string) testFunc {
+		return func(d Store) error {
+			info, err := GetPathInfo(d, path)
+			if err != nil {
+				return err
+			}
+			return compare(t, "GetPathInfo not expected", (*PathInfo)(nil), info)
+		}
+	}
+
+	// expectTree expects the entries as names followed by / for folders
+	// and the cursor of the next page
+	expectTree := func(prefix, after string, limit int, next string, entries ...string) testFunc {
+		return func(d Store) error {
+			e, n, err := ListTree(d, prefix, after, limit)
+			if err != nil {
+				return err
+			}
+
+			got := make([]string, 0, len(e))
+			for i := range e {
+				if e[i].Folder != (e[i].Info == nil) {
+					return fmt.Errorf("Entry %s has folder %v and info %v",
+						e[i].Name, e[i].Folder, e[i].Info)
+				}
+				got = append(got, e[i].key())
+			}
+			err = compare(t, "ListTree entries not expected", entries, got)
+			if err != nil {
+				return err
+			}
+			return compare(t, "ListTree next not expected", next, n)
+		}
+	}
+
+	// expectFind expects the results of the query as path=value strings
+	expectFind := func(q FindQuery, results ...string) testFunc {
+		return func(d Store) error {
+			r, err := Find(d, &q)
+			if err != nil {
+				return err
+			}
+
+			got := make([]string, 0, len(r))
+			for i := range r {
+				got = append(got, r[i].Path+"="+string(r[i].Value))
+			}
+			return compare(t, "Find results not expected", results, got)
+		}
+	}
+
+	expectHistory := func(path string, content ...string) testFunc {
+		return func(d Store) error {
+			revs, err := d.GetHistory(path)
+			if err != nil {
+				return err
+			}
+
+			texts := make([]string, 0, len(revs))
+			for i := range revs {
+				c, err := d.GetRevision(path, revs[i].Id)
+				if err != nil {
+					return err
+				}
+				for j := range c {
+					texts = append(texts, c[j].Text)
+				}
+			}
+
+			return compare(t, "history not equal", texts, content)
+		}
+	}
+
 	ctx := context.TODO()
 
 	tests := []struct {
@@ -206,77 +507,435 @@ func TestDb(t *testing.T) {
 			add("/third", "val"),
 			del("/second"),
 		}, false, []string{"/abc", "/third"}},
+		{"Deleting exact path", []testOp{
+			add("/abc", "content"),
+			add("/abc/sub", "other"),
+			add("/abcd", "val"),
+			del("/abc"),
+			expectContentVersions("/abc", 0),
+		}, false, []string{"/abc/sub", "/abcd"}},
 		{"Deleting paths recursively", []testOp{
 			add("/abc", "content"),
 			add("/abc/sub", "other"),
 			add("/third", "val"),
-			del("/abc"),
+			delTree("/abc"),
 		}, false, []string{"/third"}},
 		{"Deleting paths recursively 2", []testOp{
 			add("/abc/sip", "content"),
 			add("/abc/sub", "other"),
 			add("/abc/sub/third", "val"),
-			del("/abc/sub"),
+			delTree("/abc/sub"),
 		}, false, []string{"/abc/sip"}},
+		{"Deleting recursively only on path boundaries", []testOp{
+			add("/abc", "content"),
+			add("/abc/sub", "other"),
+			add("/abcd", "val"),
+			delTree("/abc/"),
+			expectTreeVersions("/abc", 0),
+		}, false, []string{"/abcd"}},
+		{"Deleting with wildcards", []testOp{
+			add("/a%", "content"),
+			add("/abc", "other"),
+			add("/a_c", "val"),
+			del("/a%"),
+			delTree("/a_"),
+		}, false, []string{"/a_c", "/abc"}},
+		{"Deleting recursively with wildcards", []testOp{
+			add("/a_/b", "content"),
+			add("/ab/b", "other"),
+			delTree("/a_"),
+		}, false, []string{"/ab/b"}},
+		{"Deleting conditionally", []testOp{
+			add("/abc", "content"),
+			add("/abc/sub", "other"),
+			add("/abcd", "val"),
+			delIf("/abc", true, "content"),
+		}, false, []string{"/abcd"}},
+		{"Deleting conditionally fails", []testOp{
+			add("/abc", "content"),
+			add("/abc/sub", "other"),
+			delIf("/abc", true, "other"),
+		}, true, []string{"/abc", "/abc/sub"}},
+		{"Deleting conditionally without content fails", []testOp{
+			add("/abc/sub", "other"),
+			delIf("/abc", true, "other"),
+		}, true, []string{"/abc/sub"}},
+		{"Get exact path", []testOp{
+			add("/a", "content"),
+			add("/a/first", "sub"),
+			add("/ab", "other"),
+			expectLatestContent("/a", "content"),
+			expectLatestContent("/a/", []string{}...),
+			expectLatestContent("/", []string{}...),
+		}, false, []string{"/a", "/a/first", "/ab"}},
 		{"Get recursively", []testOp{
 			add("/a/first", "content"),
 			add("/a/second", "updated"),
-			expectLatestContent("/a", "content", "updated"),
+			expectLatestContent("/a", []string{}...),
+			expectLatestTree("/a", "content", "updated"),
 		}, false, []string{"/a/first", "/a/second"}},
 		{"Get recursively 2", []testOp{
 			setReplaceInterval(0),
 			add("/a/first", "content", "second"),
 			add("/a/second", "updated"),
 			add("/a/first", "third"),
-			expectLatestContent("/a", "third", "updated"),
-			expectContentVersions("/a", 4),
+			expectLatestTree("/a", "third", "updated"),
+			expectTreeVersions("/a", 4),
 			expectContentVersions("/a/first", 3),
 			expectContentVersions("/a/second", 1),
 		}, false, []string{"/a/first", "/a/second"}},
+		{"Get recursively only on path boundaries", []testOp{
+			add("/a", "content"),
+			add("/a/first", "sub"),
+			add("/ab", "other"),
+			add("/ab/c", "third"),
+			expectLatestTree("/a", "content", "sub"),
+			expectLatestTree("/a/", "content", "sub"),
+			expectLatestTree("/", "content", "sub", "other", "third"),
+		}, false, []string{"/a", "/a/first", "/ab", "/ab/c"}},
+		{"Get with wildcards", []testOp{
+			add("/a%", "content"),
+			add("/abc", "other"),
+			add("/a_c/d", "val"),
+			add("/abc/d", "sub"),
+			expectLatestContent("/a%", "content"),
+			expectLatestContent("/a_c", []string{}...),
+			expectLatestTree("/a_c", "val"),
+			expectLatestTree("/a%", "content"),
+		}, false, []string{"/a%", "/a_c/d", "/abc", "/abc/d"}},
+		{"Content at time", []testOp{
+			setReplaceInterval(0),
+			setTime(0),
+			add("/a", "1"),
+			setTime(10),
+			add("/a", "2"),
+			setTime(20),
+			add("/a", "3"),
+			expectContentAt("/a", -1, []string{}...),
+			expectContentAt("/a", 0, "1"),
+			expectContentAt("/a", 5, "1"),
+			expectContentAt("/a", 10, "2"),
+			expectContentAt("/a", 19, "2"),
+			expectContentAt("/a", 100, "3"),
+		}, false, []string{"/a"}},
+		{"Content at time with timezones", []testOp{
+			setReplaceInterval(0),
+			setTime(0),
+			add("/a", "1"),
+			setTime(10),
+			add("/a", "2"),
+			testFunc(func(d Store) error {
+				loc := time.FixedZone("UTC+3", 3*60*60)
+				c, err := d.GetContentAt("/a", false,
+					baseTime.Add(5*time.Minute).In(loc))
+				if err != nil {
+					return err
+				}
+				return compare(t, "content count not equal", len(c), 1)
+			}),
+		}, false, []string{"/a"}},
+		{"Revisions at the same time", []testOp{
+			setReplaceInterval(0),
+			setTime(0),
+			add("/a", "1", "2", "3"),
+			add("/a/b", "sub1", "sub2"),
+			expectLatestContent("/a", "3"),
+			expectLatestTree("/a", "3", "sub2"),
+			expectContentAt("/a", 0, "3"),
+			expectTreeAt("/a", 0, "3", "sub2"),
+		}, false, []string{"/a", "/a/b"}},
+		{"Content at time recursively", []testOp{
+			setReplaceInterval(0),
+			setTime(0),
+			add("/a", "1"),
+			add("/a/b", "sub1"),
+			setTime(10),
+			add("/a/c", "sub2"),
+			add("/a/b", "sub3"),
+			add("/ab", "other"),
+			expectTreeAt("/a", 5, "1", "sub1"),
+			expectTreeAt("/a", 10, "1", "sub3", "sub2"),
+			expectContentAt("/a", 10, "1"),
+		}, false, []string{"/a", "/a/b", "/a/c", "/ab"}},
+		{"Update", []testOp{
+			setReplaceInterval(0),
+			update("/a", "1"),
+			update("/a", "2"),
+			add("/ab", "x"),
+			update("/a", "3"),
+			expectLatestContent("/a", "123"),
+			expectContentVersions("/a", 3),
+		}, false, []string{"/a", "/ab"}},
+		{"Failing update", []testOp{
+			add("/a", "1"),
+			failUpdate("/a"),
+			failUpdate("/b"),
+			expectLatestContent("/a", "1"),
+		}, false, []string{"/a"}},
+		{"Versions over limit per path", []testOp{
+			setMaxVersions(3),
+			setReplaceInterval(0),
+			add("/quiet", "1", "2"),
+			addInterleaved(20, "/a", "/b", "/c/d", "/c/e"),
+			add("/a", "final"),
+			expectHistory("/quiet", "2", "1"),
+			expectHistory("/a", "final", "/a-19", "/a-18"),
+			expectHistory("/b", "/b-19", "/b-18", "/b-17"),
+			expectHistory("/c/d", "/c/d-19", "/c/d-18", "/c/d-17"),
+			expectTreeVersions("/c", 6),
+		}, false, []string{"/a", "/b", "/c/d", "/c/e", "/quiet"}},
+		{"Versions over limit with a busy path", []testOp{
+			setMaxVersions(5),
+			setReplaceInterval(0),
+			add("/a", "1", "2", "3"),
+			addInterleaved(50, "/busy"),
+			expectContentVersions("/a", 3),
+			expectContentVersions("/busy", 5),
+		}, false, []string{"/a", "/busy"}},
+		{"Retention rule versions", []testOp{
+			setReplaceInterval(0),
+			setRetention(Retention{Prefix: "/a", MaxVersions: 2}),
+			add("/b", "1", "2", "3"),
+			add("/a/c", "1", "2", "3"),
+			expectContentVersions("/a/c", 2),
+			expectContentVersions("/b", 3),
+		}, false, []string{"/a/c", "/b"}},
+		{"Retention rule replace interval", []testOp{
+			setRetention(Retention{Prefix: "/a", MaxVersions: 5,
+				ReplaceInterval: 0}),
+			add("/a", "1", "2", "3"),
+			add("/b", "1", "2", "3"),
+			expectContentVersions("/a", 3),
+			expectContentVersions("/b", 1),
+		}, false, []string{"/a", "/b"}},
+		{"Retention max age", []testOp{
+			setReplaceInterval(0),
+			setRetention(Retention{Prefix: "/a", MaxVersions: 10,
+				MaxAge: time.Hour}),
+			setTime(0),
+			add("/a", "1"),
+			add("/b", "1"),
+			setTime(30),
+			add("/a", "2"),
+			setTime(70),
+			add("/a", "3"),
+			expectHistory("/a", "3", "2"),
+			setTime(200),
+			expectCompact(1),
+			expectHistory("/a", "3"),
+			expectCompact(0),
+		}, false, []string{"/a", "/b"}},
+		{"Retention keep daily", []testOp{
+			setReplaceInterval(0),
+			setRetention(Retention{Prefix: "", MaxVersions: 10,
+				KeepDaily: 2}),
+			setTime(0),
+			add("/a", "day0-1"),
+			setTime(60),
+			add("/a", "day0-2"),
+			setTime(24 * 60),
+			add("/a", "day1-1"),
+			setTime(25 * 60),
+			add("/a", "day1-2"),
+			setTime(48 * 60),
+			add("/a", "day2-1"),
+			expectHistory("/a", "day2-1", "day1-2", "day1-1", "day0-2"),
+			setTime(49 * 60),
+			expectCompact(1),
+			expectHistory("/a", "day2-1", "day1-2", "day0-2"),
+			setTime(73 * 60),
+			expectCompact(1),
+			expectHistory("/a", "day2-1", "day1-2"),
+			setTime(1000 * 60),
+			expectCompact(1),
+			expectHistory("/a", "day2-1"),
+		}, false, []string{"/a"}},
+		{"List paths", []testOp{
+			setReplaceInterval(0),
+			setTime(0),
+			add("a", "1", "2"),
+			add("b", "1"),
+			add("b/c", "1", "2", "3"),
+			add("b-c", "1"),
+			add("bc", "1"),
+			expectList(ListQuery{}, "a:2", "b:1", "b-c:1", "b/c:3", "bc:1"),
+			expectList(ListQuery{Limit: 2}, "a:2", "b:1"),
+			expectList(ListQuery{After: "b", Limit: 2}, "b-c:1", "b/c:3"),
+			expectList(ListQuery{Prefix: "b"}, "b:1", "b/c:3"),
+			expectList(ListQuery{Prefix: "b/", After: "b"}, "b/c:3"),
+			expectList(ListQuery{After: "bc"}, []string{}...),
+		}, false, []string{"a", "b", "b-c", "b/c", "bc"}},
+		{"Path information", []testOp{
+			setReplaceInterval(0),
+			setTime(1),
+			add("a", "1"),
+			setTime(5),
+			add("a", "12"),
+			setTime(7),
+			add("a", `"äö"`),
+			add("a/b", "1"),
+			expectInfo("a", 1, 7, 3, 6),
+			expectInfo("a/b", 7, 7, 1, 1),
+			expectNoInfo("a/"),
+			expectNoInfo("b"),
+			setMaxVersions(2),
+			add("a", "123"),
+			expectInfo("a", 7, 7, 2, 3),
+		}, false, []string{"a", "a/b"}},
+		{"List tree", []testOp{
+			setTime(0),
+			add("a", "1"),
+			add("b", "1"),
+			add("b-c", "1"),
+			add("b/c", "1"),
+			add("b/d/e", "1"),
+			add("b/d/f", "1"),
+			add("c/d", "1"),
+			add("e", "1"),
+			expectTree("", "", 0, "", "a", "b", "b-c", "b/", "c/", "e"),
+			expectTree("", "", 2, "b", "a", "b"),
+			expectTree("", "b", 2, "b/", "b-c", "b/"),
+			expectTree("", "b/", 2, "", "c/", "e"),
+			expectTree("", "b/", 1, "c/", "c/"),
+			expectTree("", "e", 2, "", []string{}...),
+			expectTree("b", "", 0, "", "c", "d/"),
+			expectTree("b/", "c", 1, "", "d/"),
+			expectTree("b/d", "", 1, "e", "e"),
+			expectTree("x", "", 0, "", []string{}...),
+		}, false, []string{"a", "b", "b-c", "b/c", "b/d/e", "b/d/f", "c/d", "e"}},
+		{"Find", []testOp{
+			setReplaceInterval(0),
+			add("/a", `{"n":1,"s":"x"}`),
+			add("/a", `{"n":5,"s":"y","o":{"b":[true]}}`),
+			add("/b", `{"n":2.5,"s":"a","o":null}`),
+			add("/c", `{"n":"5"}`, `not json`),
+			add("/d/e", `[{"n":3}]`),
+			expectFind(FindQuery{Field: "$.n", Op: "exists"},
+				`/a=5`, `/b=2.5`),
+			expectFind(FindQuery{Field: "$.n", Op: "eq", Value: `5`}, `/a=5`),
+			expectFind(FindQuery{Field: "$.n", Op: "eq", Value: `5.0`}, `/a=5`),
+			expectFind(FindQuery{Field: "$.n", Op: "eq", Value: `1`}, []string{}...),
+			expectFind(FindQuery{Field: "$.n", Op: "ne", Value: `5`}, `/b=2.5`),
+			expectFind(FindQuery{Field: "$.n", Op: "lt", Value: `3`}, `/b=2.5`),
+			expectFind(FindQuery{Field: "$.n", Op: "ge", Value: `2.5`},
+				`/a=5`, `/b=2.5`),
+			expectFind(FindQuery{Field: "$.s", Op: "gt", Value: `"b"`}, `/a="y"`),
+			expectFind(FindQuery{Field: "$.o", Op: "eq", Value: `null`}, `/b=null`),
+			expectFind(FindQuery{Field: "$.o", Op: "exists"},
+				`/a={"b":[true]}`, `/b=null`),
+			expectFind(FindQuery{Field: "$.o.b[0]", Op: "eq", Value: `true`},
+				`/a=true`),
+			expectFind(FindQuery{Field: "$.o.b[#-1]", Op: "ne", Value: `false`},
+				`/a=true`),
+			expectFind(FindQuery{Field: "$[0].n", Op: "exists"}, `/d/e=3`),
+		}, false, []string{"/a", "/b", "/c", "/d/e"}},
+		{"Find with wildcards", []testOp{
+			expectFind(FindQuery{Field: "$..n", Op: "exists"}),
+		}, true, []string{}},
+		{"Find with paging", []testOp{
+			add("/a", `{"n":1}`),
+			add("/b", `{"n":2}`),
+			add("/b/c", `{"n":3}`),
+			add("/bc", `{"n":4}`),
+			add("/c", `{"n":5}`),
+			expectFind(FindQuery{Field: "$.n", Op: "exists", Limit: 2},
+				`/a=1`, `/b=2`),
+			expectFind(FindQuery{Field: "$.n", Op: "exists", After: "/b", Limit: 2},
+				`/b/c=3`, `/bc=4`),
+			expectFind(FindQuery{Field: "$.n", Op: "exists", Prefix: "/b"},
+				`/b=2`, `/b/c=3`),
+			expectFind(FindQuery{Field: "$.n", Op: "exists", Prefix: "/b/", After: "/b"},
+				`/b/c=3`),
+		}, false, []string{"/a", "/b", "/b/c", "/bc", "/c"}},
+		{"Find with invalid value", []testOp{
+			expectFind(FindQuery{Field: "$.n", Op: "eq", Value: `{"a":1}`}),
+		}, true, []string{}},
+		{"Find with invalid operator", []testOp{
+			expectFind(FindQuery{Field: "$.n", Op: "lt", Value: `true`}),
+		}, true, []string{}},
+		{"History", []testOp{
+			setReplaceInterval(0),
+			add("/a", "1", "2", "3"),
+			add("/ab", "other"),
+			expectHistory("/a", "3", "2", "1"),
+			expectHistory("/ab", "other"),
+			expectHistory("/b", []string{}...),
+		}, false, []string{"/a", "/ab"}},
+	}
+	backends := []struct {
+		name string
+		open func(t *testing.T) (Store, error)
+	}{
+		{"sqlite", func(t *testing.T) (Store, error) {
+			// Remove the dbfile before testing
+			_ = os.Remove(dbfile)
+			return CreateDb(dbfile, ctx)
+		}},
+		{"memory", func(t *testing.T) (Store, error) {
+			return NewMemStore(), nil
+		}},
+		{"file", func(t *testing.T) (Store, error) {
+			return NewFileStore(t.TempDir())
+		}},
 	}
-	for _, tt := range tests {
-		// Remove the dbfile before testing
-		_ = os.Remove(dbfile)
-
-		db, err := CreateDb(dbfile, ctx)
-		if err != nil {
-			t.Errorf("Setting up db failed with error = %v", err)
-			return
-		}
 
-		t.Run(tt.name, func(t *testing.T) {
-			var failed bool = false
-			fail := struct {
-				failed bool
-				err    error
-				i      int
-			}{}
-			for i, op := range tt.ops {
-				err := op.run(db)
-				failed = failed || (err != nil)
-				if failed && !fail.failed {
-					fail.failed = true
-					fail.err = err
-					fail.i = i
-				}
+	// The PostgreSQL backend is tested if a database is given or can be
+	// started in a container
+	if dsn := postgresDsn(t); dsn != "" {
+		backends = append(backends, struct {
+			name string
+			open func(t *testing.T) (Store, error)
+		}{"postgres", func(t *testing.T) (Store, error) {
+			s, err := CreatePgStore(dsn, ctx)
+			if err != nil {
+				return nil, err
 			}
-			if failed != tt.wantErr {
-				t.Errorf("op no.%d error = %v, wantErr %v", fail.i, fail.err, tt.wantErr)
+			_, err = s.db.Exec(`TRUNCATE dump, content, token RESTART IDENTITY CASCADE;`)
+			return s, err
+		}})
+	}
+
+	for _, backend := range backends {
+		for _, tt := range tests {
+			db, err := backend.open(t)
+			if err != nil {
+				t.Errorf("Setting up db failed with error = %v", err)
 				return
 			}
-			paths, err := db.GetPaths()
+
+			t.Run(backend.name+"/"+tt.name, func(t *testing.T) {
+				var failed bool = false
+				fail := struct {
+					failed bool
+					err    error
+					i      int
+				}{}
+				for i, op := range tt.ops {
+					err := op.run(db)
+					failed = failed || (err != nil)
+					if failed && !fail.failed {
+						fail.failed = true
+						fail.err = err
+						fail.i = i
+					}
+				}
+				if failed != tt.wantErr {
+					t.Errorf("op no.%d error = %v, wantErr %v", fail.i, fail.err, tt.wantErr)
+					return
+				}
+				paths, err := db.GetPaths()
+				if err != nil {
+					t.Errorf("Getting paths failed with error = %v",
+						err)
+					return
+				}
+				_ = compare(t, "db.GetPaths not expected", paths, tt.wantPaths)
+			})
+			err = db.Close()
 			if err != nil {
-				t.Errorf("Getting paths failed with error = %v",
-					err)
+				t.Errorf("Closing db failed with error = %v", err)
 				return
 			}
-			_ = compare(t, "db.GetPaths not expected", paths, tt.wantPaths)
-		})
-		err = db.Close()
-		if err != nil {
-			t.Errorf("Closing db failed with error = %v", err)
-			return
 		}
-
 	}
 }
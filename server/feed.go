@@ -0,0 +1,295 @@
+package jsondump
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Change is an update or a delete of a path
+type Change struct {
+	// Type is update or delete
+	Type string
+
+	Path string
+
+	// Id is the id of the updated revision
+	Id int `json:",omitempty"`
+
+	Date time.Time
+
+	// Recursive is set if the paths below the deleted path were deleted
+	Recursive bool `json:",omitempty"`
+
+	// Content is the updated revision if it was requested
+	Content json.RawMessage `json:",omitempty"`
+}
+
+// updateChange returns the change of storing the revision
+func updateChange(c *Content) Change {
+	return Change{
+		Type:    "update",
+		Path:    c.Path,
+		Id:      c.Id,
+		Date:    c.Date,
+		Content: json.RawMessage(c.Text),
+	}
+}
+
+// feedSize is the number of the latest changes kept for replaying
+const feedSize = 1000
+
+// feedEvent is a change with its sequence number
+type feedEvent struct {
+	seq    int64
+	change Change
+}
+
+// subscription receives the changes under the prefix or, if match is set,
+// the changes it accepts
+type subscription struct {
+	prefix string
+	match  func(c *Change) bool
+	events chan feedEvent
+
+	// start is the sequence number of the latest change when subscribing
+	start int64
+
+	// closed is set when the subscriber is too slow and the events channel
+	// has been closed
+	closed bool
+}
+
+// changeMatches returns true if the change affects the paths under the
+// prefix
+func changeMatches(c *Change, prefix string) bool {
+	return hasPathPrefix(c.Path, prefix) || (c.Recursive && hasPathPrefix(prefix, c.Path))
+}
+
+func (s *subscription) matches(c *Change) bool {
+	if s.match != nil {
+		return s.match(c)
+	}
+	return changeMatches(c, s.prefix)
+}
+
+// feed distributes the changes to the subscriptions. The ids of the events
+// are the epoch of the feed and the sequence number of the change, so the
+// ids given to another feed are detected.
+type feed struct {
+	mutex  sync.Mutex
+	epoch  string
+	seq    int64
+	events []feedEvent
+	subs   map[*subscription]struct{}
+
+	// closed is set when the server shuts down
+	closed bool
+}
+
+func newFeed() *feed {
+	return &feed{
+		epoch: strconv.FormatInt(time.Now().UnixNano(), 36),
+		subs:  map[*subscription]struct{}{},
+	}
+}
+
+func (f *feed) eventId(seq int64) string {
+	return fmt.Sprintf("%s-%d", f.epoch, seq)
+}
+
+// publish sends the change to the subscriptions of its path. The
+// subscriptions that cannot keep up are closed.
+func (f *feed) publish(c Change) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.seq++
+	e := feedEvent{seq: f.seq, change: c}
+	f.events = append(f.events, e)
+	if len(f.events) > feedSize {
+		f.events = f.events[len(f.events)-feedSize:]
+	}
+
+	for s := range f.subs {
+		if !s.matches(&c) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			s.closed = true
+			close(s.events)
+			delete(f.subs, s)
+		}
+	}
+}
+
+// subscribe subscribes to the changes under the prefix. The changes after
+// the event lastId are returned for replaying. Returns also false if the
+// changes after lastId are no longer known.
+func (f *feed) subscribe(prefix, lastId string) (*subscription, []feedEvent, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	s := f.add(&subscription{prefix: strings.Trim(prefix, "/")})
+
+	if lastId == "" {
+		return s, nil, true
+	}
+
+	var last int64 = -1
+	if strings.HasPrefix(lastId, f.epoch+"-") {
+		seq, err := strconv.ParseInt(strings.TrimPrefix(lastId, f.epoch+"-"), 10, 64)
+		if err == nil && seq <= f.seq {
+			last = seq
+		}
+	}
+
+	oldest := f.seq + 1
+	if len(f.events) > 0 {
+		oldest = f.events[0].seq
+	}
+	if last < 0 || last+1 < oldest {
+		return s, nil, false
+	}
+
+	var replay []feedEvent
+	for _, e := range f.events {
+		if e.seq > last && s.matches(&e.change) {
+			replay = append(replay, e)
+		}
+	}
+	return s, replay, true
+}
+
+// subscribeFunc subscribes to the changes for which match returns true. The
+// match is called with the feed locked when a change is published.
+func (f *feed) subscribeFunc(match func(c *Change) bool) *subscription {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.add(&subscription{match: match})
+}
+
+// add starts the subscription. The mutex must be held.
+func (f *feed) add(s *subscription) *subscription {
+	s.events = make(chan feedEvent, 64)
+	s.start = f.seq
+	if f.closed {
+		s.closed = true
+		close(s.events)
+	} else {
+		f.subs[s] = struct{}{}
+	}
+	return s
+}
+
+func (f *feed) unsubscribe(s *subscription) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if !s.closed {
+		delete(f.subs, s)
+		close(s.events)
+		s.closed = true
+	}
+}
+
+// close ends the subscriptions for the server to shut down without
+// waiting for the streams. The later subscriptions are closed immediately.
+func (f *feed) close() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.closed = true
+	for s := range f.subs {
+		s.closed = true
+		close(s.events)
+		delete(f.subs, s)
+	}
+}
+
+// isClosed returns true if the feed has been closed
+func (f *feed) isClosed() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.closed
+}
+
+// writeEvent writes the change as a server-sent event
+func writeEvent(w http.ResponseWriter, id string, c Change, content bool) error {
+	if !content {
+		c.Content = nil
+	}
+	js, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", id, c.Type, js)
+	return err
+}
+
+// watch streams the changes under the prefix parameter as server-sent
+// events. The content of the updates is included if the content parameter
+// is set. A reset event is sent first if the changes after the
+// Last-Event-ID are not known.
+func (ra *RestApi) watch(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+
+	// The stream is not limited by the WriteTimeout of the server
+	err := rc.SetWriteDeadline(time.Time{})
+	if err != nil && err != http.ErrNotSupported {
+		respond(w, "", err, http.StatusInternalServerError)
+		return
+	}
+
+	q := r.URL.Query()
+	content := isSet(q, "content")
+	s, replay, ok := ra.feed.subscribe(q.Get("prefix"), r.Header.Get("Last-Event-ID"))
+	defer ra.feed.unsubscribe(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	// Reconnect after a second
+	_, err = fmt.Fprintf(w, "retry: 1000\n\n")
+	if err == nil && !ok {
+		_, err = fmt.Fprintf(w, "id: %s\nevent: reset\ndata: {}\n\n", ra.feed.eventId(s.start))
+	}
+	for i := 0; err == nil && i < len(replay); i++ {
+		err = writeEvent(w, ra.feed.eventId(replay[i].seq), replay[i].change, content)
+	}
+	if err == nil {
+		err = rc.Flush()
+	}
+	if err != nil {
+		return
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-s.events:
+			if !ok {
+				// Too slow or shutting down, the client replays the
+				// missed events
+				return
+			}
+			err := writeEvent(w, ra.feed.eventId(e.seq), e.change, content)
+			if err == nil {
+				err = rc.Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
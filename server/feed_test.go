@@ -0,0 +1,184 @@
+package jsondump
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kopoli/appkit"
+)
+
+func TestFeed(t *testing.T) {
+	paths := func(events []feedEvent) []string {
+		ret := []string{}
+		for i := range events {
+			ret = append(ret, events[i].change.Path)
+		}
+		return ret
+	}
+
+	f := newFeed()
+	for _, c := range []Change{
+		{Type: "update", Path: "a/x"},
+		{Type: "update", Path: "b/x"},
+		{Type: "update", Path: "ab"},
+		{Type: "delete", Path: "a", Recursive: true},
+		{Type: "update", Path: "a/y"},
+	} {
+		f.publish(c)
+	}
+
+	tests := []struct {
+		name   string
+		prefix string
+		lastId string
+		want   []string
+		wantOk bool
+	}{
+		{"No last id", "a", "", []string{}, true},
+		{"Replay all", "", f.eventId(0), []string{"a/x", "b/x", "ab", "a", "a/y"}, true},
+		{"Replay prefix", "a", f.eventId(1), []string{"a", "a/y"}, true},
+		{"Recursive delete of parent", "/a/x/", f.eventId(0), []string{"a/x", "a"}, true},
+		{"Nothing missed", "", f.eventId(5), []string{}, true},
+		{"Future id", "", f.eventId(6), []string{}, false},
+		{"Other feed", "", "other-1", []string{}, false},
+		{"Invalid id", "", "invalid", []string{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, replay, ok := f.subscribe(tt.prefix, tt.lastId)
+			defer f.unsubscribe(s)
+			if ok != tt.wantOk {
+				t.Errorf("subscribe() ok = %v, want %v", ok, tt.wantOk)
+			}
+			_ = compare(t, "subscribe() replay not expected", tt.want, paths(replay))
+			if s.start != 5 {
+				t.Errorf("subscribe() start = %d, want 5", s.start)
+			}
+		})
+	}
+
+	t.Run("Expired events", func(t *testing.T) {
+		f := newFeed()
+		for i := 0; i < feedSize+2; i++ {
+			f.publish(Change{Type: "update", Path: "a"})
+		}
+		s, _, ok := f.subscribe("", f.eventId(1))
+		f.unsubscribe(s)
+		if ok {
+			t.Errorf("subscribe() of expired id ok = true")
+		}
+		s, replay, ok := f.subscribe("", f.eventId(2))
+		f.unsubscribe(s)
+		if !ok || len(replay) != feedSize {
+			t.Errorf("subscribe() of oldest id ok = %v, replayed %d", ok, len(replay))
+		}
+	})
+
+	t.Run("Publish", func(t *testing.T) {
+		f := newFeed()
+		s, _, _ := f.subscribe("a", "")
+		defer f.unsubscribe(s)
+		f.publish(Change{Type: "update", Path: "b"})
+		f.publish(Change{Type: "update", Path: "a/x"})
+
+		e := <-s.events
+		_ = compare(t, "Published event not expected",
+			feedEvent{2, Change{Type: "update", Path: "a/x"}}, e)
+	})
+
+	t.Run("Slow subscriber", func(t *testing.T) {
+		f := newFeed()
+		s, _, _ := f.subscribe("", "")
+		for i := 0; i < cap(s.events)+1; i++ {
+			f.publish(Change{Type: "update", Path: "a"})
+		}
+
+		n := 0
+		for range s.events {
+			n++
+		}
+		if n != cap(s.events) {
+			t.Errorf("Received %d events, want %d", n, cap(s.events))
+		}
+		f.unsubscribe(s)
+	})
+
+	t.Run("Filtered subscriber", func(t *testing.T) {
+		f := newFeed()
+		s := f.subscribeFunc(func(c *Change) bool { return c.Path == "a" })
+		defer f.unsubscribe(s)
+		for i := 0; i < cap(s.events)+1; i++ {
+			f.publish(Change{Type: "update", Path: "b"})
+		}
+		f.publish(Change{Type: "update", Path: "a"})
+
+		e, ok := <-s.events
+		if !ok {
+			t.Fatalf("Subscription closed by the changes it does not receive")
+		}
+		_ = compare(t, "Published event not expected",
+			feedEvent{int64(cap(s.events) + 2), Change{Type: "update", Path: "a"}}, e)
+	})
+}
+
+func TestWatchStream(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listening failed with error = %v", err)
+	}
+	url := "http://" + l.Addr().String() + "/api/"
+
+	f := newFeed()
+	h, _ := createHandler(NewMemStore(), appkit.NewOptions(), newMetrics(), f, nil)
+	srv := &http.Server{
+		Handler:      h,
+		WriteTimeout: 100 * time.Millisecond,
+	}
+	srv.RegisterOnShutdown(f.close)
+	go func() {
+		_ = srv.Serve(l)
+	}()
+
+	resp, err := http.Get(url + "?watch&prefix=a")
+	if err != nil {
+		t.Fatalf("Watch failed with error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	// The stream outlasts the WriteTimeout
+	time.Sleep(300 * time.Millisecond)
+	req, err := http.NewRequest("PUT", url+"a", strings.NewReader(`"a"`))
+	if err == nil {
+		var put *http.Response
+		put, err = http.DefaultClient.Do(req)
+		if err == nil {
+			put.Body.Close()
+		}
+	}
+	if err != nil {
+		t.Fatalf("PUT failed with error = %v", err)
+	}
+
+	events := bufio.NewScanner(resp.Body)
+	for events.Scan() && events.Text() != "event: update" {
+	}
+	if events.Err() != nil || events.Text() != "event: update" {
+		t.Fatalf("Expected an update event, got %q with error = %v",
+			events.Text(), events.Err())
+	}
+
+	// The shutdown does not wait for the stream
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = srv.Shutdown(ctx)
+	if err != nil {
+		t.Errorf("Shutdown() failed with error = %v", err)
+	}
+	for events.Scan() {
+	}
+}
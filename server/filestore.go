@@ -0,0 +1,242 @@
+package jsondump
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fileStorage keeps each path in its own directory and each revision in its
+// own file:
+//
+//	<dir>/sequence                      the last used revision id
+//	<dir>/paths/<escaped path>/<id>-<unix nanoseconds>.json
+//
+// The directory of a path is removed with its last revision. The last used
+// revision id is cached, so the directory can be used by one process only.
+type fileStorage struct {
+	dir    string
+	lastId int
+
+	// writable caches the readiness check of the directory
+	writable writableCheck
+}
+
+// NewFileStore creates a Store that keeps the data as files in the
+// directory dir
+func NewFileStore(dir string) (Store, error) {
+	f := &fileStorage{dir: dir}
+
+	err := os.MkdirAll(f.pathsDir(), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(f.sequenceFile())
+	if err == nil {
+		f.lastId, err = strconv.Atoi(strings.TrimSpace(string(data)))
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Reading the revision sequence failed: %v", err)
+	}
+
+	return newGenericStore(f), nil
+}
+
+func (f *fileStorage) pathsDir() string {
+	return filepath.Join(f.dir, "paths")
+}
+
+func (f *fileStorage) sequenceFile() string {
+	return filepath.Join(f.dir, "sequence")
+}
+
+// escapePath escapes the path to a directory name. Only ASCII letters,
+// digits, '-' and '_' are kept as is.
+func escapePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(c >= '0' && c <= '9') || c == '-' || c == '_' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func (f *fileStorage) pathDir(path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("Empty path")
+	}
+	return filepath.Join(f.pathsDir(), escapePath(path)), nil
+}
+
+func revisionFile(c *Content) string {
+	return fmt.Sprintf("%d-%d.json", c.Id, c.Date.UnixNano())
+}
+
+// parseRevisionFile parses the id and date from the revision file name
+func parseRevisionFile(name string) (int, time.Time, error) {
+	var id int
+	var nsec int64
+	_, err := fmt.Sscanf(name, "%d-%d.json", &id, &nsec)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("Invalid revision file %s: %v", name, err)
+	}
+	return id, time.Unix(0, nsec), nil
+}
+
+func (f *fileStorage) paths() ([]string, error) {
+	entries, err := ioutil.ReadDir(f.pathsDir())
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]string, 0, len(entries))
+	for _, e := range entries {
+		p, err := url.PathUnescape(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, p)
+	}
+	return ret, nil
+}
+
+func (f *fileStorage) revisions(path string) ([]Content, error) {
+	dir, err := f.pathDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []Content{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]Content, 0, len(entries))
+	for _, e := range entries {
+		// Skip the revisions being written
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		id, date, err := parseRevisionFile(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		text, err := ioutil.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, Content{
+			Path: path,
+			Id:   id,
+			Text: string(text),
+			Date: date,
+		})
+	}
+	return ret, nil
+}
+
+func (f *fileStorage) nextId() (int, error) {
+	id := f.lastId + 1
+	err := writeFileAtomic(f.sequenceFile(), []byte(strconv.Itoa(id)))
+	if err != nil {
+		return 0, err
+	}
+	f.lastId = id
+	return id, nil
+}
+
+// writeFileAtomic writes the file so that it is either fully written or not
+// changed at all
+func writeFileAtomic(name string, data []byte) error {
+	tmp := name + ".tmp"
+	err := ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func (f *fileStorage) write(c *Content) error {
+	dir, err := f.pathDir(c.Path)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	// The hidden temporary file is not listed as a revision
+	tmp, err := ioutil.TempFile(dir, ".revision-*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.WriteString(c.Text)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(dir, revisionFile(c)))
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (f *fileStorage) remove(path string, id int) error {
+	dir, err := f.pathDir(path)
+	if err != nil {
+		return err
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dir, fmt.Sprintf("%d-*.json", id)))
+	if err != nil {
+		return err
+	}
+	for _, m := range matches {
+		err = os.Remove(m)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The path is gone with its last revision
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil || len(entries) > 0 {
+		return err
+	}
+	return os.Remove(dir)
+}
+
+func (f *fileStorage) removePath(path string) error {
+	dir, err := f.pathDir(path)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func (f *fileStorage) close() error {
+	return nil
+}
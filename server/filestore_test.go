@@ -0,0 +1,48 @@
+package jsondump
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestFileStorage(t *testing.T) {
+	f := &fileStorage{dir: t.TempDir()}
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	revs := []Content{
+		{Path: "a/b", Id: 1, Text: "1", Date: now},
+		{Path: "a/b", Id: 2, Text: "2", Date: now.Add(time.Minute)},
+	}
+
+	expectPaths := func(want ...string) {
+		t.Helper()
+		got, err := f.paths()
+		if err != nil {
+			t.Fatalf("paths() failed with error = %v", err)
+		}
+		_ = compare(t, "Paths not expected", want, got)
+	}
+
+	for i := range revs {
+		err := f.write(&revs[i])
+		if err != nil {
+			t.Fatalf("write() failed with error = %v", err)
+		}
+	}
+	expectPaths("a/b")
+
+	dir, _ := f.pathDir("a/b")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Reading the path directory failed with error = %v", err)
+	}
+	_ = compare(t, "Revision files not expected", 2, len(entries))
+
+	for i := range revs {
+		err := f.remove("a/b", revs[i].Id)
+		if err != nil {
+			t.Fatalf("remove() failed with error = %v", err)
+		}
+	}
+	expectPaths([]string{}...)
+}
@@ -0,0 +1,359 @@
+package jsondump
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// FindQuery selects the paths whose latest revision has a value matching
+// the predicate
+type FindQuery struct {
+	// Prefix limits the search to the prefix and the paths below it
+	Prefix string
+
+	// Field is the JSON path of the compared value, e.g. $.a.b[0]
+	Field string
+
+	// Op is one of exists, eq, ne, lt, le, gt and ge
+	Op string
+
+	// Value is the JSON of the scalar the field is compared to. It is not
+	// used with the exists operator.
+	Value string
+
+	// After returns only the paths after it in ascending order
+	After string
+
+	// Limit is the maximum number of results. Zero or negative means all.
+	Limit int
+}
+
+// FindResult is the latest revision of a matching path with the value of
+// the field
+type FindResult struct {
+	Path  string
+	Id    int
+	Date  time.Time
+	Value json.RawMessage
+}
+
+// Finder is implemented by the stores that can evaluate FindQuery
+// themselves. The other stores are searched by reading their latest
+// revisions.
+type Finder interface {
+	Find(q *FindQuery) ([]FindResult, error)
+}
+
+// Find returns the results of the query from the store in the ascending
+// order of paths
+func Find(s Store, q *FindQuery) ([]FindResult, error) {
+	if f, ok := s.(Finder); ok {
+		return f.Find(q)
+	}
+	return findContent(s, q)
+}
+
+// findPredicate is a validated FindQuery predicate
+type findPredicate struct {
+	field *jsonPath
+	op    string
+
+	// kind of the value: number, text, true, false or null
+	kind  string
+	value interface{}
+}
+
+// jsonKind returns the kind of the decoded JSON value as in findPredicate
+func jsonKind(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	case json.Number, float64:
+		return "number"
+	case string:
+		return "text"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+func (q *FindQuery) predicate() (*findPredicate, error) {
+	field, err := parseJsonPath(q.Field)
+	if err != nil {
+		return nil, err
+	}
+	if !field.definite {
+		return nil, fmt.Errorf("Field must not contain wildcards")
+	}
+
+	ret := &findPredicate{
+		field: field,
+		op:    q.Op,
+	}
+
+	switch q.Op {
+	case "exists":
+		return ret, nil
+	case "eq", "ne", "lt", "le", "gt", "ge":
+	default:
+		return nil, fmt.Errorf("Unknown operator: %s", q.Op)
+	}
+
+	value, err := decodeJson(q.Value)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid value: %v", err)
+	}
+
+	ret.kind = jsonKind(value)
+	switch ret.kind {
+	case "number":
+		ret.value, err = value.(json.Number).Float64()
+		if err != nil {
+			return nil, err
+		}
+	case "text":
+		ret.value = value
+	case "true":
+		ret.value = 1
+	case "false":
+		ret.value = 0
+	case "null":
+		ret.value = nil
+	default:
+		return nil, fmt.Errorf("Value must be a number, string, boolean or null")
+	}
+
+	if q.Op != "eq" && q.Op != "ne" && ret.kind != "number" && ret.kind != "text" {
+		return nil, fmt.Errorf("Operator %s needs a number or a string", q.Op)
+	}
+
+	return ret, nil
+}
+
+// compareScalars returns a negative number, zero or a positive number if a is
+// less than, equal to or greater than b. Both are of the same kind.
+func compareScalars(a, b interface{}) int {
+	switch av := a.(type) {
+	case float64:
+		bv := b.(float64)
+		switch {
+		case av < bv:
+			return -1
+		case av > bv:
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(av, b.(string))
+	}
+	return 0
+}
+
+// match returns true if the decoded document matches the predicate and
+// the value of the field
+func (p *findPredicate) match(doc interface{}) (bool, interface{}) {
+	values := []interface{}{doc}
+	for i := range p.field.steps {
+		values = p.field.steps[i].apply(values)
+	}
+	if len(values) == 0 {
+		return false, nil
+	}
+
+	value := values[0]
+	if p.op == "exists" {
+		return true, value
+	}
+
+	kind := jsonKind(value)
+	equal := false
+	cmp := 0
+	if kind == p.kind {
+		switch v := value.(type) {
+		case json.Number:
+			f, err := v.Float64()
+			if err != nil {
+				return false, nil
+			}
+			cmp = compareScalars(f, p.value)
+		case string:
+			cmp = compareScalars(v, p.value)
+		}
+		equal = cmp == 0
+	}
+
+	switch p.op {
+	case "eq":
+		return equal, value
+	case "ne":
+		return !equal, value
+	case "lt":
+		return kind == p.kind && cmp < 0, value
+	case "le":
+		return kind == p.kind && cmp <= 0, value
+	case "gt":
+		return kind == p.kind && cmp > 0, value
+	case "ge":
+		return kind == p.kind && cmp >= 0, value
+	}
+	return false, nil
+}
+
+// findContent evaluates the query on the latest revisions of the store.
+// Revisions that are not valid JSON do not match.
+func findContent(s Store, q *FindQuery) ([]FindResult, error) {
+	p, err := q.predicate()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := s.GetContent(q.Prefix, true, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []FindResult{}
+	for i := range c {
+		if c[i].Path <= q.After {
+			continue
+		}
+
+		doc, err := decodeJson(c[i].Text)
+		if err != nil {
+			continue
+		}
+
+		ok, value := p.match(doc)
+		if !ok {
+			continue
+		}
+
+		js, err := encodeJson(value)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, FindResult{
+			Path:  c[i].Path,
+			Id:    c[i].Id,
+			Date:  c[i].Date,
+			Value: js,
+		})
+		if q.Limit > 0 && len(ret) >= q.Limit {
+			break
+		}
+	}
+
+	return ret, nil
+}
+
+// sqlitePath returns the path in the syntax of the SQLite JSON functions
+func (p *jsonPath) sqlitePath() (string, error) {
+	var b strings.Builder
+	b.WriteString("$")
+	for _, step := range p.steps {
+		switch step.kind {
+		case stepMember:
+			if strings.ContainsRune(step.name, '"') {
+				return "", fmt.Errorf("Member names must not contain \"")
+			}
+			fmt.Fprintf(&b, `."%s"`, step.name)
+		case stepIndex:
+			if step.fromEnd {
+				fmt.Fprintf(&b, "[#-%d]", step.index)
+			} else {
+				fmt.Fprintf(&b, "[%d]", step.index)
+			}
+		default:
+			return "", fmt.Errorf("Wildcards are not supported")
+		}
+	}
+	return b.String(), nil
+}
+
+// Find evaluates the query with the JSON functions of SQLite
+func (db *Db) Find(q *FindQuery) ([]FindResult, error) {
+	p, err := q.predicate()
+	if err != nil {
+		return nil, err
+	}
+
+	field, err := p.field.sqlitePath()
+	if err != nil {
+		return nil, err
+	}
+
+	conditions := map[string]string{
+		"exists": `type IS NOT NULL`,
+		"eq":     `kind = @kind AND value IS @value`,
+		"ne":     `type IS NOT NULL AND NOT (kind = @kind AND value IS @value)`,
+		"lt":     `kind = @kind AND value < @value`,
+		"le":     `kind = @kind AND value <= @value`,
+		"gt":     `kind = @kind AND value > @value`,
+		"ge":     `kind = @kind AND value >= @value`,
+	}
+
+	query := `
+SELECT path, id, added, json FROM (
+  SELECT path, id, added, type, value, json,
+         CASE type WHEN 'integer' THEN 'number' WHEN 'real' THEN 'number'
+                   ELSE type END AS kind
+  FROM (
+    -- The field of the latest revisions that are valid JSON
+    SELECT path, id, added,
+           CASE WHEN json_valid(text) THEN json_type(text, @field) END AS type,
+           CASE WHEN json_valid(text) THEN json_extract(text, @field) END AS value,
+           CASE WHEN json_valid(text) THEN text -> @field END AS json
+    FROM (
+      SELECT content.id, content.text, content.added, dump.path,
+             row_number() OVER (PARTITION BY dump.path ORDER BY content.added DESC, content.id DESC) AS count
+      FROM content, dump
+      WHERE (dump.path = @path OR (@recursive AND dump.path LIKE @subtree ESCAPE '\')) AND
+        dump.id = content.dumpid AND dump.path > @after)
+    WHERE count = 1))
+WHERE ` + conditions[p.op] + `
+ORDER BY path
+LIMIT @limit;
+`
+	ret := []FindResult{}
+
+	row := func(rows *sql.Rows) error {
+		var r FindResult
+		var value string
+		err := rows.Scan(&r.Path, &r.Id, &r.Date, &value)
+		if err != nil {
+			return err
+		}
+		r.Value = json.RawMessage(value)
+		ret = append(ret, r)
+		return nil
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+
+	args := append(pathArgs(q.Prefix, true),
+		sql.Named("field", field),
+		sql.Named("kind", p.kind),
+		sql.Named("value", p.value),
+		sql.Named("after", q.After),
+		sql.Named("limit", limit),
+	)
+
+	err = db.query(query, row, args...)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
@@ -0,0 +1,420 @@
+package jsondump
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// revisionStorage has the primitive operations of a storage. The
+// genericStore implements the Store on top of them.
+type revisionStorage interface {
+	// paths lists the stored paths in any order
+	paths() ([]string, error)
+
+	// revisions lists the revisions of the path in any order
+	revisions(path string) ([]Content, error)
+
+	// nextId returns an unused revision id
+	nextId() (int, error)
+
+	// write stores the revision
+	write(c *Content) error
+
+	// remove removes the revision id of the path
+	remove(path string, id int) error
+
+	// removePath removes the path and its revisions
+	removePath(path string) error
+
+	close() error
+}
+
+type genericStore struct {
+	storage   revisionStorage
+	mutex     sync.RWMutex
+	now       func() time.Time
+	retention RetentionPolicy
+}
+
+func newGenericStore(storage revisionStorage) *genericStore {
+	return &genericStore{
+		storage: storage,
+		now:     time.Now,
+		retention: RetentionPolicy{
+			MaxVersions:     defaultVersions,
+			ReplaceInterval: replaceInterval,
+		},
+	}
+}
+
+// newestFirst sorts the revisions in the order they are returned
+func newestFirst(revs []Content) {
+	sort.SliceStable(revs, func(i, j int) bool {
+		if !revs[i].Date.Equal(revs[j].Date) {
+			return revs[i].Date.After(revs[j].Date)
+		}
+		return revs[i].Id > revs[j].Id
+	})
+}
+
+// sortedRevisions lists the revisions of the path newest first
+func (s *genericStore) sortedRevisions(path string) ([]Content, error) {
+	revs, err := s.storage.revisions(path)
+	if err != nil {
+		return nil, err
+	}
+	newestFirst(revs)
+	return revs, nil
+}
+
+// matchPaths lists the path and optionally the paths below it in ascending
+// order. The paths are matched the same way as in the Db.
+func (s *genericStore) matchPaths(path string, recursive bool) ([]string, error) {
+	paths, err := s.storage.paths()
+	if err != nil {
+		return nil, err
+	}
+
+	if recursive {
+		path = strings.TrimSuffix(path, "/")
+	}
+
+	ret := []string{}
+	for _, p := range paths {
+		if p == path || (recursive &&
+			(path == "" || strings.HasPrefix(p, path+"/"))) {
+			ret = append(ret, p)
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// expired returns the ids of the revisions that the policy removes. The
+// revisions must be sorted newest first.
+func expired(revs []Content, policy Retention, now time.Time) []int {
+	// The database compares the times in millisecond precision
+	older := func(c *Content, t time.Time) bool {
+		return c.Date.Truncate(time.Millisecond).Before(t.Truncate(time.Millisecond))
+	}
+
+	day := 24 * time.Hour
+	newestOfDay := map[string]bool{}
+	ret := []int{}
+	for i := range revs {
+		c := &revs[i]
+		date := c.Date.UTC().Format("2006-01-02")
+		remove := i >= policy.MaxVersions
+		if i > 0 && policy.MaxAge > 0 && older(c, now.Add(-policy.MaxAge)) {
+			remove = true
+		}
+		if policy.KeepDaily > 0 {
+			if older(c, now.Add(-day)) && newestOfDay[date] {
+				remove = true
+			}
+			if i > 0 && older(c, now.Add(-time.Duration(policy.KeepDaily)*day)) {
+				remove = true
+			}
+		}
+		newestOfDay[date] = true
+
+		if remove {
+			ret = append(ret, c.Id)
+		}
+	}
+	return ret
+}
+
+// trim removes the revisions of the path according to the retention policy.
+// Returns the number of removed revisions.
+func (s *genericStore) trim(path string, now time.Time) (int64, error) {
+	revs, err := s.sortedRevisions(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var ret int64
+	defer func() {
+		s.retention.countRemoved(ret)
+	}()
+
+	for _, id := range expired(revs, s.retention.lookup(path), now) {
+		err = s.storage.remove(path, id)
+		if err != nil {
+			return ret, err
+		}
+		ret++
+	}
+	return ret, nil
+}
+
+func (s *genericStore) add(path, content string) (*Content, error) {
+	policy := s.retention.lookup(path)
+	added := s.now()
+	from := added.Add(-policy.ReplaceInterval)
+
+	revs, err := s.storage.revisions(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove the content in the replace interval in the same second
+	// precision as the database
+	for i := range revs {
+		sec := revs[i].Date.Unix()
+		if sec > from.Unix() && sec <= added.Unix() {
+			err = s.storage.remove(path, revs[i].Id)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	id, err := s.storage.nextId()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Content{
+		Path: path,
+		Id:   id,
+		Text: content,
+		Date: added,
+	}
+	err = s.storage.write(c)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.trim(path, added)
+	return c, err
+}
+
+func (s *genericStore) Add(path, content string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.add(path, content)
+	return err
+}
+
+func (s *genericStore) Update(path string, fn func(cur *Content) (string, error)) (*Content, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	revs, err := s.sortedRevisions(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cur *Content
+	if len(revs) > 0 {
+		cur = &revs[0]
+	}
+
+	content, err := fn(cur)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.add(path, content)
+}
+
+func (s *genericStore) Delete(path string, recursive bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.deletePaths(path, recursive)
+}
+
+func (s *genericStore) DeleteIf(path string, recursive bool, fn func(cur *Content) error) (*Content, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	revs, err := s.sortedRevisions(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cur *Content
+	if len(revs) > 0 {
+		cur = &revs[0]
+	}
+
+	err = fn(cur)
+	if err == nil {
+		err = s.deletePaths(path, recursive)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cur, nil
+}
+
+// deletePaths removes the path and optionally the paths below it. The mutex
+// must be held.
+func (s *genericStore) deletePaths(path string, recursive bool) error {
+	paths, err := s.matchPaths(path, recursive)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		err = s.storage.removePath(p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *genericStore) GetPaths() ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.matchPaths("", true)
+}
+
+func (s *genericStore) ListPaths(q *ListQuery) ([]PathInfo, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	paths, err := s.matchPaths(q.Prefix, true)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []PathInfo{}
+	for _, p := range paths {
+		if p <= q.After {
+			continue
+		}
+		if q.Limit > 0 && len(ret) >= q.Limit {
+			break
+		}
+
+		revs, err := s.sortedRevisions(p)
+		if err != nil {
+			return nil, err
+		}
+		if len(revs) == 0 {
+			continue
+		}
+
+		ret = append(ret, PathInfo{
+			Path:      p,
+			Added:     revs[len(revs)-1].Date,
+			Modified:  revs[0].Date,
+			Revisions: len(revs),
+			Size:      len(revs[0].Text),
+		})
+	}
+	return ret, nil
+}
+
+// getContent gets the revisions selected by fn from each of the matching
+// paths. The fn gets the revisions newest first.
+func (s *genericStore) getContent(path string, recursive bool,
+	fn func(revs []Content) []Content) ([]Content, error) {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	paths, err := s.matchPaths(path, recursive)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []Content{}
+	for _, p := range paths {
+		revs, err := s.sortedRevisions(p)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, fn(revs)...)
+	}
+	return ret, nil
+}
+
+func (s *genericStore) GetContent(path string, recursive bool, numLatest int) ([]Content, error) {
+	return s.getContent(path, recursive, func(revs []Content) []Content {
+		if numLatest >= 0 && len(revs) > numLatest {
+			return revs[:numLatest]
+		}
+		return revs
+	})
+}
+
+func (s *genericStore) GetContentAt(path string, recursive bool, at time.Time) ([]Content, error) {
+	at = at.Truncate(time.Millisecond)
+	return s.getContent(path, recursive, func(revs []Content) []Content {
+		for i := range revs {
+			if !revs[i].Date.Truncate(time.Millisecond).After(at) {
+				return revs[i : i+1]
+			}
+		}
+		return nil
+	})
+}
+
+func (s *genericStore) GetHistory(path string) ([]Revision, error) {
+	revs, err := s.GetContent(path, false, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]Revision, 0, len(revs))
+	for i := range revs {
+		ret = append(ret, Revision{
+			Path: revs[i].Path,
+			Id:   revs[i].Id,
+			Date: revs[i].Date,
+		})
+	}
+	return ret, nil
+}
+
+func (s *genericStore) GetRevision(path string, id int) ([]Content, error) {
+	return s.getContent(path, false, func(revs []Content) []Content {
+		for i := range revs {
+			if revs[i].Id == id {
+				return revs[i : i+1]
+			}
+		}
+		return nil
+	})
+}
+
+func (s *genericStore) Retention() *RetentionPolicy {
+	return &s.retention
+}
+
+func (s *genericStore) Compact() (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	paths, err := s.storage.paths()
+	if err != nil {
+		return 0, err
+	}
+
+	var ret int64
+	now := s.now()
+	for _, p := range paths {
+		n, err := s.trim(p, now)
+		ret += n
+		if err != nil {
+			return ret, err
+		}
+	}
+	return ret, nil
+}
+
+func (s *genericStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.storage.close()
+}
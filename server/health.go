@@ -0,0 +1,148 @@
+package jsondump
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ReadinessChecker is implemented by the stores that can check if they are
+// able to serve requests
+type ReadinessChecker interface {
+	// CheckReady returns the reason the store is not ready or nil
+	CheckReady() error
+}
+
+// CheckReady checks if the store is ready. The stores that do not implement
+// ReadinessChecker are always ready.
+func CheckReady(s Store) error {
+	if c, ok := s.(ReadinessChecker); ok {
+		return c.CheckReady()
+	}
+	return nil
+}
+
+// checkWritable checks that a file can be written to the directory
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".jsondump-ready-")
+	if err != nil {
+		return fmt.Errorf("Directory %s is not writable: %v", dir, err)
+	}
+
+	_, err = f.Write([]byte("ready"))
+	cerr := f.Close()
+	rerr := os.Remove(f.Name())
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return fmt.Errorf("Directory %s is not writable: %v", dir, err)
+	}
+	return nil
+}
+
+// writableInterval is the time the result of checking that a directory is
+// writable is reused
+const writableInterval = time.Minute
+
+// writableCheck caches the result of checkWritable to not write a file on
+// each probe
+type writableCheck struct {
+	mutex   sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func (c *writableCheck) check(dir string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.checked.IsZero() || time.Since(c.checked) >= writableInterval {
+		c.err = checkWritable(dir)
+		c.checked = time.Now()
+	}
+	return c.err
+}
+
+// checkSchemaVersion checks that all migrations are applied
+func checkSchemaVersion(version int, err error, expected int) error {
+	if err != nil {
+		return fmt.Errorf("Database is not reachable: %v", err)
+	}
+	if version != expected {
+		return fmt.Errorf("Database schema version is %d, expected %d",
+			version, expected)
+	}
+	return nil
+}
+
+func (db *Db) CheckReady() error {
+	version, err := db.SchemaVersion()
+	err = checkSchemaVersion(version, err, len(migrations))
+	if err != nil {
+		return err
+	}
+
+	// The in-memory databases have no file
+	var file sql.NullString
+	err = db.db.QueryRowContext(db.ctx, `
+SELECT file FROM pragma_database_list WHERE name = 'main';`).Scan(&file)
+	if err != nil {
+		return err
+	}
+	if file.String == "" {
+		return nil
+	}
+	return db.writable.check(filepath.Dir(file.String))
+}
+
+func (s *genericStore) CheckReady() error {
+	if c, ok := s.storage.(interface{ checkReady() error }); ok {
+		return c.checkReady()
+	}
+	return nil
+}
+
+func (f *fileStorage) checkReady() error {
+	return f.writable.check(f.pathsDir())
+}
+
+func (s *PgStore) CheckReady() error {
+	version, err := s.SchemaVersion()
+	return checkSchemaVersion(version, err, len(pgMigrations))
+}
+
+// serveHealth responds that the process is alive
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	respond(w, `"ok"`, nil, http.StatusOK)
+}
+
+// errNotReady is the reason given to the public probes, which should not
+// see the details of the server
+var errNotReady = errors.New("Not ready")
+
+// serveReady responds if the store is ready to serve requests. The reason
+// is logged and given only if detailed is set.
+func serveReady(db Store, detailed bool, l *Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := CheckReady(db)
+		if err != nil {
+			l.Warn("Not ready", "error", err, "request_id", requestId(r))
+			if !detailed {
+				err = errNotReady
+			}
+			respond(w, "", err, http.StatusServiceUnavailable)
+			return
+		}
+		respond(w, `"ready"`, nil, http.StatusOK)
+	}
+}
@@ -0,0 +1,119 @@
+package jsondump
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kopoli/appkit"
+)
+
+func TestCheckReady(t *testing.T) {
+	_ = os.Remove(dbfile)
+	db, err := CreateDb(dbfile, context.TODO())
+	if err != nil {
+		t.Fatalf("Setting up db failed with error = %v", err)
+	}
+	defer db.Close()
+
+	err = CheckReady(db)
+	if err != nil {
+		t.Errorf("CheckReady() failed with error = %v", err)
+	}
+
+	_, err = db.db.ExecContext(db.ctx, "PRAGMA user_version=1;")
+	if err != nil {
+		t.Fatalf("Setting schema version failed with error = %v", err)
+	}
+	err = CheckReady(db)
+	if err == nil || !strings.Contains(err.Error(), "schema version") {
+		t.Errorf("CheckReady() error = %v, want schema version error", err)
+	}
+
+	err = CheckReady(NewMemStore())
+	if err != nil {
+		t.Errorf("CheckReady() of memory store failed with error = %v", err)
+	}
+
+	fs, err := NewFileStore(t.TempDir())
+	if err == nil {
+		err = CheckReady(fs)
+	}
+	if err != nil {
+		t.Errorf("CheckReady() of file store failed with error = %v", err)
+	}
+
+	err = checkWritable("/nonexistent/dir")
+	if err == nil {
+		t.Errorf("checkWritable() of a missing directory should fail")
+	}
+
+	// The result is reused until the interval passes
+	var c writableCheck
+	dir := filepath.Join(t.TempDir(), "dir")
+	err = os.Mkdir(dir, 0755)
+	if err == nil {
+		err = c.check(dir)
+	}
+	if err != nil {
+		t.Errorf("check() failed with error = %v", err)
+	}
+	_ = os.Remove(dir)
+	if err = c.check(dir); err != nil {
+		t.Errorf("check() did not reuse the result, error = %v", err)
+	}
+	c.checked = c.checked.Add(-writableInterval)
+	if err = c.check(dir); err == nil {
+		t.Errorf("check() of a removed directory should fail")
+	}
+}
+
+// unreadyStore is a store that is never ready
+type unreadyStore struct {
+	Store
+}
+
+func (s *unreadyStore) CheckReady() error {
+	return errors.New("Directory /data is not writable")
+}
+
+func TestProbes(t *testing.T) {
+	auth := appkit.NewOptions()
+	auth.Set("auth", "t")
+
+	ready, _ := createHandler(NewMemStore(), appkit.NewOptions(), newMetrics(), newFeed(), nil)
+	unready, _ := createHandler(&unreadyStore{NewMemStore()}, appkit.NewOptions(), newMetrics(), newFeed(), nil)
+	authenticated, _ := createHandler(NewMemStore(), auth, newMetrics(), newFeed(), nil)
+	admin := createAdminHandler(&unreadyStore{NewMemStore()}, appkit.NewOptions(), newMetrics(), nil)
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		path    string
+		want    int
+		body    string
+	}{
+		{"Alive", ready, "/healthz", http.StatusOK, `"ok"`},
+		{"Ready", ready, "/readyz", http.StatusOK, `"ready"`},
+		{"Alive when not ready", unready, "/healthz", http.StatusOK, `"ok"`},
+		{"Not ready", unready, "/readyz", http.StatusServiceUnavailable, `"data": "Not ready"`},
+		{"No authentication", authenticated, "/readyz", http.StatusOK, `"ready"`},
+		{"API authentication", authenticated, "/api/a", http.StatusUnauthorized, `"fail"`},
+		{"Admin", admin, "/readyz", http.StatusServiceUnavailable, `"Directory /data is not writable"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.handler.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+			_ = compare(t, "Status not expected", tt.want, w.Code)
+			if !strings.Contains(w.Body.String(), tt.body) {
+				t.Errorf("Body %s does not contain %s", w.Body.String(), tt.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,493 @@
+package jsondump
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PatchOp is a single JSON Patch (RFC 6902) operation
+type PatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// decodeJson decodes the text into generic values keeping the numbers as
+// they were written.
+func decodeJson(text string) (interface{}, error) {
+	var ret interface{}
+	dec := json.NewDecoder(strings.NewReader(text))
+	dec.UseNumber()
+	err := dec.Decode(&ret)
+	return ret, err
+}
+
+func encodeJson(value interface{}) (json.RawMessage, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// diffValues appends the operations that transform a into b at the pointer
+// path.
+func diffValues(ops []PatchOp, path string, a, b interface{}) ([]PatchOp, error) {
+	op := func(name string, path string, value interface{}) error {
+		p := PatchOp{Op: name, Path: path}
+		if name != "remove" {
+			v, err := encodeJson(value)
+			if err != nil {
+				return err
+			}
+			p.Value = v
+		}
+		ops = append(ops, p)
+		return nil
+	}
+
+	var err error
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		for _, k := range sortedKeys(av) {
+			p := path + "/" + pointerEscaper.Replace(k)
+			if _, ok := bv[k]; !ok {
+				err = op("remove", p, nil)
+			} else {
+				ops, err = diffValues(ops, p, av[k], bv[k])
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, k := range sortedKeys(bv) {
+			if _, ok := av[k]; ok {
+				continue
+			}
+			err = op("add", path+"/"+pointerEscaper.Replace(k), bv[k])
+			if err != nil {
+				return nil, err
+			}
+		}
+		return ops, nil
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		common := len(av)
+		if len(bv) < common {
+			common = len(bv)
+		}
+		for i := 0; i < common; i++ {
+			ops, err = diffValues(ops, path+"/"+strconv.Itoa(i), av[i], bv[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+		for i := len(av) - 1; i >= common; i-- {
+			err = op("remove", path+"/"+strconv.Itoa(i), nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for i := common; i < len(bv); i++ {
+			err = op("add", path+"/"+strconv.Itoa(i), bv[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+		return ops, nil
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		err = op("replace", path, b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ops, nil
+}
+
+// Diff returns the JSON Patch that transforms the JSON document from into
+// the document to.
+func Diff(from, to string) ([]PatchOp, error) {
+	a, err := decodeJson(from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := decodeJson(to)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffValues([]PatchOp{}, "", a, b)
+}
+
+var pointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+
+// parsePointer splits the JSON Pointer (RFC 6901) into its reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("Invalid JSON pointer: %s", pointer)
+	}
+	ret := strings.Split(pointer[1:], "/")
+	for i := range ret {
+		ret[i] = pointerUnescaper.Replace(ret[i])
+	}
+	return ret, nil
+}
+
+// arrayIndex parses the token as an array index that may be at most max
+func arrayIndex(token string, max int) (int, error) {
+	idx, err := strconv.Atoi(token)
+	if err != nil || idx < 0 || idx > max ||
+		(len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("Invalid array index: %s", token)
+	}
+	return idx, nil
+}
+
+// walk finds the container of the value referred by tokens and replaces it
+// with the value returned by leaf. The leaf gets the container and the last
+// token. Returns the modified document.
+func walk(doc interface{}, tokens []string,
+	leaf func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+
+	if len(tokens) == 1 {
+		return leaf(doc, tokens[0])
+	}
+
+	token := tokens[0]
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		child, ok := d[token]
+		if !ok {
+			return nil, fmt.Errorf("Member %s not found", token)
+		}
+		v, err := walk(child, tokens[1:], leaf)
+		if err != nil {
+			return nil, err
+		}
+		d[token] = v
+		return d, nil
+	case []interface{}:
+		idx, err := arrayIndex(token, len(d)-1)
+		if err != nil {
+			return nil, err
+		}
+		v, err := walk(d[idx], tokens[1:], leaf)
+		if err != nil {
+			return nil, err
+		}
+		d[idx] = v
+		return d, nil
+	}
+	return nil, fmt.Errorf("Cannot refer to %s of a scalar value", token)
+}
+
+func getValue(doc interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			v, ok := d[token]
+			if !ok {
+				return nil, fmt.Errorf("Member %s not found", token)
+			}
+			doc = v
+		case []interface{}:
+			idx, err := arrayIndex(token, len(d)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = d[idx]
+		default:
+			return nil, fmt.Errorf("Cannot refer to %s of a scalar value", token)
+		}
+	}
+	return doc, nil
+}
+
+func addValue(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return walk(doc, tokens, func(c interface{}, token string) (interface{}, error) {
+		switch d := c.(type) {
+		case map[string]interface{}:
+			d[token] = value
+			return d, nil
+		case []interface{}:
+			idx := len(d)
+			if token != "-" {
+				var err error
+				idx, err = arrayIndex(token, len(d))
+				if err != nil {
+					return nil, err
+				}
+			}
+			d = append(d, nil)
+			copy(d[idx+1:], d[idx:])
+			d[idx] = value
+			return d, nil
+		}
+		return nil, fmt.Errorf("Cannot add %s to a scalar value", token)
+	})
+}
+
+func removeValue(doc interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("Cannot remove the whole document")
+	}
+	return walk(doc, tokens, func(c interface{}, token string) (interface{}, error) {
+		switch d := c.(type) {
+		case map[string]interface{}:
+			if _, ok := d[token]; !ok {
+				return nil, fmt.Errorf("Member %s not found", token)
+			}
+			delete(d, token)
+			return d, nil
+		case []interface{}:
+			idx, err := arrayIndex(token, len(d)-1)
+			if err != nil {
+				return nil, err
+			}
+			return append(d[:idx], d[idx+1:]...), nil
+		}
+		return nil, fmt.Errorf("Cannot remove %s of a scalar value", token)
+	})
+}
+
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(v))
+		for k := range v {
+			ret[k] = copyValue(v[k])
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i := range v {
+			ret[i] = copyValue(v[i])
+		}
+		return ret
+	}
+	return value
+}
+
+// equalValues compares JSON values. Numbers are compared by their values.
+func equalValues(a, b interface{}) bool {
+	switch av := a.(type) {
+	case json.Number:
+		bv, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		if av == bv {
+			return true
+		}
+		af, aerr := av.Float64()
+		bf, berr := bv.Float64()
+		return aerr == nil && berr == nil && af == bf
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k := range av {
+			v, ok := bv[k]
+			if !ok || !equalValues(av[k], v) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !equalValues(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func applyOp(doc interface{}, op PatchOp) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	value := func() (interface{}, error) {
+		if len(op.Value) == 0 {
+			return nil, fmt.Errorf("Operation %s is missing a value", op.Op)
+		}
+		return decodeJson(string(op.Value))
+	}
+
+	from := func() ([]string, interface{}, error) {
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, nil, err
+		}
+		v, err := getValue(doc, from)
+		return from, v, err
+	}
+
+	switch op.Op {
+	case "add":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, v)
+	case "remove":
+		return removeValue(doc, path)
+	case "replace":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		if len(path) == 0 {
+			return v, nil
+		}
+		doc, err = removeValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, v)
+	case "move":
+		fromPath, v, err := from()
+		if err != nil {
+			return nil, err
+		}
+		if op.From == op.Path {
+			return doc, nil
+		}
+		if strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, fmt.Errorf("Cannot move %s into itself", op.From)
+		}
+		doc, err = removeValue(doc, fromPath)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, v)
+	case "copy":
+		_, v, err := from()
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, copyValue(v))
+	case "test":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		cur, err := getValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !equalValues(cur, v) {
+			return nil, fmt.Errorf("Test of %s failed", op.Path)
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("Unknown patch operation: %s", op.Op)
+}
+
+// ApplyPatch applies the JSON Patch (RFC 6902) to the JSON document. An
+// empty document is treated as null.
+func ApplyPatch(doc string, patch []PatchOp) (string, error) {
+	if doc == "" {
+		doc = "null"
+	}
+
+	v, err := decodeJson(doc)
+	if err != nil {
+		return "", err
+	}
+
+	for i := range patch {
+		v, err = applyOp(v, patch[i])
+		if err != nil {
+			return "", err
+		}
+	}
+
+	ret, err := encodeJson(v)
+	return string(ret), err
+}
+
+func mergeValues(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergeValues(t[k], v)
+		}
+	}
+	return t
+}
+
+// MergePatch applies the JSON Merge Patch (RFC 7396) to the JSON document.
+// An empty document is treated as null.
+func MergePatch(doc string, patch string) (string, error) {
+	if doc == "" {
+		doc = "null"
+	}
+
+	target, err := decodeJson(doc)
+	if err != nil {
+		return "", err
+	}
+
+	p, err := decodeJson(patch)
+	if err != nil {
+		return "", err
+	}
+
+	ret, err := encodeJson(mergeValues(target, p))
+	return string(ret), err
+}
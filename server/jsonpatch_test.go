@@ -0,0 +1,173 @@
+package jsondump
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name    string
+		from    string
+		to      string
+		want    string
+		wantErr bool
+	}{
+		{"Equal documents", `{"a":1}`, `{"a":1}`, `[]`, false},
+		{"Replace root", `1`, `"a"`,
+			`[{"op":"replace","path":"","value":"a"}]`, false},
+		{"Replace with null", `{"a":1}`, `{"a":null}`,
+			`[{"op":"replace","path":"/a","value":null}]`, false},
+		{"Add and remove members", `{"a":1,"b":2}`, `{"b":2,"c":3}`,
+			`[{"op":"remove","path":"/a"},{"op":"add","path":"/c","value":3}]`, false},
+		{"Nested objects", `{"a":{"b":{"c":1}}}`, `{"a":{"b":{"c":2}}}`,
+			`[{"op":"replace","path":"/a/b/c","value":2}]`, false},
+		{"Escaped member names", `{"a/b":1,"c~d":2}`, `{"a/b":3,"c~d":4}`,
+			`[{"op":"replace","path":"/a~1b","value":3},{"op":"replace","path":"/c~0d","value":4}]`, false},
+		{"Array grows", `[1,2]`, `[1,3,4,5]`,
+			`[{"op":"replace","path":"/1","value":3},{"op":"add","path":"/2","value":4},{"op":"add","path":"/3","value":5}]`, false},
+		{"Array shrinks", `[1,2,3,4]`, `[1]`,
+			`[{"op":"remove","path":"/3"},{"op":"remove","path":"/2"},{"op":"remove","path":"/1"}]`, false},
+		{"Type changes", `{"a":[1]}`, `{"a":{"0":1}}`,
+			`[{"op":"replace","path":"/a","value":{"0":1}}]`, false},
+		{"Large numbers are kept", `{"a":12345678901234567890}`, `{"a":12345678901234567891}`,
+			`[{"op":"replace","path":"/a","value":12345678901234567891}]`, false},
+		{"Invalid from", `{`, `1`, ``, true},
+		{"Invalid to", `1`, `{`, ``, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Diff(tt.from, tt.to)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Diff() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			b, err := json.Marshal(got)
+			if err != nil {
+				t.Errorf("Marshalling patch failed with error = %v", err)
+				return
+			}
+			_ = compare(t, "Diff() not expected", tt.want, string(b))
+		})
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		patch   string
+		want    string
+		wantErr bool
+	}{
+		{"Empty patch", `{"a":1}`, `[]`, `{"a":1}`, false},
+		{"Add member", `{"a":1}`, `[{"op":"add","path":"/b","value":[1]}]`,
+			`{"a":1,"b":[1]}`, false},
+		{"Add array element", `{"a":[1,2]}`, `[{"op":"add","path":"/a/1","value":3}]`,
+			`{"a":[1,3,2]}`, false},
+		{"Append array element", `{"a":[1,2]}`, `[{"op":"add","path":"/a/-","value":3}]`,
+			`{"a":[1,2,3]}`, false},
+		{"Add to empty document", ``, `[{"op":"add","path":"","value":{"a":1}}]`,
+			`{"a":1}`, false},
+		{"Add to nonexistent parent", `{}`, `[{"op":"add","path":"/a/b","value":1}]`,
+			``, true},
+		{"Add past the array end", `[1]`, `[{"op":"add","path":"/2","value":1}]`,
+			``, true},
+		{"Remove member", `{"a":1,"b":2}`, `[{"op":"remove","path":"/a"}]`,
+			`{"b":2}`, false},
+		{"Remove array element", `[1,2,3]`, `[{"op":"remove","path":"/1"}]`,
+			`[1,3]`, false},
+		{"Remove nonexistent member", `{"a":1}`, `[{"op":"remove","path":"/b"}]`,
+			``, true},
+		{"Replace member", `{"a":1}`, `[{"op":"replace","path":"/a","value":null}]`,
+			`{"a":null}`, false},
+		{"Replace array element", `[1,2]`, `[{"op":"replace","path":"/1","value":3}]`,
+			`[1,3]`, false},
+		{"Replace nonexistent member", `{"a":1}`, `[{"op":"replace","path":"/b","value":2}]`,
+			``, true},
+		{"Replace without value", `{"a":1}`, `[{"op":"replace","path":"/a"}]`,
+			``, true},
+		{"Move member", `{"a":{"b":1},"c":{}}`, `[{"op":"move","from":"/a/b","path":"/c/d"}]`,
+			`{"a":{},"c":{"d":1}}`, false},
+		{"Move array element", `[1,2,3]`, `[{"op":"move","from":"/0","path":"/2"}]`,
+			`[2,3,1]`, false},
+		{"Move into itself", `{"a":{"b":1}}`, `[{"op":"move","from":"/a","path":"/a/c"}]`,
+			``, true},
+		{"Move to the same path", `{"a":1}`, `[{"op":"move","from":"/a","path":"/a"}]`,
+			`{"a":1}`, false},
+		{"Move nonexistent to the same path", `{"a":1}`, `[{"op":"move","from":"/b","path":"/b"}]`,
+			``, true},
+		{"Copy member", `{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"},{"op":"add","path":"/c/d","value":2}]`,
+			`{"a":{"b":1},"c":{"b":1,"d":2}}`, false},
+		{"Test succeeds", `{"a":[1.0,"x"]}`, `[{"op":"test","path":"/a","value":[1,"x"]}]`,
+			`{"a":[1.0,"x"]}`, false},
+		{"Test fails", `{"a":1}`, `[{"op":"test","path":"/a","value":"1"}]`,
+			``, true},
+		{"Escaped pointer", `{"a/b":{"c~d":1}}`, `[{"op":"replace","path":"/a~1b/c~0d","value":2}]`,
+			`{"a/b":{"c~d":2}}`, false},
+		{"Invalid pointer", `{"a":1}`, `[{"op":"remove","path":"a"}]`,
+			``, true},
+		{"Invalid array index", `[1,2]`, `[{"op":"remove","path":"/01"}]`,
+			``, true},
+		{"Unknown operation", `{"a":1}`, `[{"op":"frobnicate","path":"/a"}]`,
+			``, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ops []PatchOp
+			err := json.Unmarshal([]byte(tt.patch), &ops)
+			if err != nil {
+				t.Errorf("Unmarshalling patch failed with error = %v", err)
+				return
+			}
+			got, err := ApplyPatch(tt.doc, ops)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ApplyPatch() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			_ = compare(t, "ApplyPatch() not expected", tt.want, got)
+		})
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		patch   string
+		want    string
+		wantErr bool
+	}{
+		{"Replace member", `{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`, false},
+		{"Add member", `{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`, false},
+		{"Remove member", `{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`, false},
+		{"Replace array", `{"a":["b"]}`, `{"a":["c"]}`, `{"a":["c"]}`, false},
+		{"Replace with array", `{"a":"c"}`, `["b"]`, `["b"]`, false},
+		{"Nested members", `{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`,
+			`{"a":{"b":"d"}}`, false},
+		{"Object to scalar", `{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`, false},
+		{"Scalar to object", `["a","b"]`, `{"a":{"bb":{"ccc":null}}}`,
+			`{"a":{"bb":{}}}`, false},
+		{"Empty document", ``, `{"a":1,"b":null}`, `{"a":1}`, false},
+		{"Invalid patch", `{}`, `{`, ``, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MergePatch(tt.doc, tt.patch)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("MergePatch() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			_ = compare(t, "MergePatch() not expected", tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package jsondump
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type stepKind int
+
+const (
+	stepMember stepKind = iota
+	stepIndex
+	stepWildcard
+	stepDescendants
+)
+
+// pathStep is a single step of a JSON path
+type pathStep struct {
+	kind stepKind
+	name string
+
+	// index of the array element, counted from the end if fromEnd is set
+	index   int
+	fromEnd bool
+}
+
+// jsonPath is a parsed JSON path. A definite path selects at most one
+// value.
+type jsonPath struct {
+	steps    []pathStep
+	definite bool
+}
+
+// parseQuoted parses the quoted name beginning at s[i]. Returns the name
+// and the index after the closing quote.
+func parseQuoted(s string, i int) (string, int, error) {
+	quote := s[i]
+	end := i + 1
+	for ; end < len(s) && s[end] != quote; end++ {
+		if s[end] == '\\' {
+			end++
+		}
+	}
+	if end >= len(s) {
+		return "", 0, fmt.Errorf("Unterminated quoted name")
+	}
+
+	name := s[i+1 : end]
+	if quote == '"' {
+		err := json.Unmarshal([]byte(s[i:end+1]), &name)
+		if err != nil {
+			return "", 0, err
+		}
+	} else {
+		name = strings.NewReplacer(`\'`, `'`, `\\`, `\`).Replace(name)
+	}
+	return name, end + 1, nil
+}
+
+// parseBracket parses the bracketed step beginning at s[i]. Returns the
+// index after the closing bracket.
+func parseBracket(s string, i int) (pathStep, int, error) {
+	var step pathStep
+	i++
+	if i < len(s) && (s[i] == '"' || s[i] == '\'') {
+		name, end, err := parseQuoted(s, i)
+		if err != nil {
+			return step, 0, err
+		}
+		step = pathStep{kind: stepMember, name: name}
+		i = end
+	} else {
+		end := strings.IndexByte(s[i:], ']')
+		if end < 0 {
+			return step, 0, fmt.Errorf("Missing ]")
+		}
+		token := s[i : i+end]
+		i += end
+
+		if token == "*" {
+			step.kind = stepWildcard
+		} else {
+			step.kind = stepIndex
+			if strings.HasPrefix(token, "#-") || strings.HasPrefix(token, "-") {
+				step.fromEnd = true
+				token = strings.TrimLeft(token, "#-")
+			}
+			idx, err := strconv.Atoi(token)
+			if err != nil || idx < 0 || (step.fromEnd && idx == 0) {
+				return step, 0, fmt.Errorf("Invalid array index: %s", s[i-end:i])
+			}
+			step.index = idx
+		}
+	}
+
+	if i >= len(s) || s[i] != ']' {
+		return step, 0, fmt.Errorf("Missing ]")
+	}
+	return step, i + 1, nil
+}
+
+// parseJsonPath parses the JSON path. The path starts with $ and is followed
+// by .name, ."name", ['name'], [n], [-n] or [#-n] for the n:th element from
+// the end, .* or [*] for all members and ..name for the descendants.
+func parseJsonPath(path string) (*jsonPath, error) {
+	fail := func(i int, err error) (*jsonPath, error) {
+		return nil, fmt.Errorf("Invalid JSON path %q at %d: %v", path, i, err)
+	}
+
+	if !strings.HasPrefix(path, "$") {
+		return fail(0, fmt.Errorf("Must start with $"))
+	}
+
+	ret := &jsonPath{definite: true}
+	i := 1
+	for i < len(path) {
+		var step pathStep
+		var err error
+		start := i
+
+		switch path[i] {
+		case '[':
+			step, i, err = parseBracket(path, i)
+		case '.':
+			i++
+			if i < len(path) && path[i] == '.' {
+				ret.steps = append(ret.steps, pathStep{kind: stepDescendants})
+				ret.definite = false
+				i++
+				if i < len(path) && path[i] == '[' {
+					continue
+				}
+			}
+			switch {
+			case i >= len(path):
+				err = fmt.Errorf("Missing name")
+			case path[i] == '*':
+				step.kind = stepWildcard
+				i++
+			case path[i] == '"':
+				step.name, i, err = parseQuoted(path, i)
+			default:
+				end := strings.IndexAny(path[i:], ".[")
+				if end < 0 {
+					end = len(path) - i
+				}
+				if end == 0 {
+					err = fmt.Errorf("Missing name")
+				}
+				step.name = path[i : i+end]
+				i += end
+			}
+		default:
+			err = fmt.Errorf("Unexpected %q", path[i])
+		}
+		if err != nil {
+			return fail(start, err)
+		}
+
+		if step.kind == stepWildcard {
+			ret.definite = false
+		}
+		ret.steps = append(ret.steps, step)
+	}
+
+	return ret, nil
+}
+
+// descendants appends the value and all values contained in it
+func descendants(ret []interface{}, value interface{}) []interface{} {
+	ret = append(ret, value)
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, k := range sortedKeys(v) {
+			ret = descendants(ret, v[k])
+		}
+	case []interface{}:
+		for i := range v {
+			ret = descendants(ret, v[i])
+		}
+	}
+	return ret
+}
+
+// apply returns the values selected by the step from each of the values
+func (step *pathStep) apply(values []interface{}) []interface{} {
+	ret := []interface{}{}
+	for _, value := range values {
+		switch step.kind {
+		case stepMember:
+			if m, ok := value.(map[string]interface{}); ok {
+				if v, ok := m[step.name]; ok {
+					ret = append(ret, v)
+				}
+			}
+		case stepIndex:
+			if a, ok := value.([]interface{}); ok {
+				idx := step.index
+				if step.fromEnd {
+					idx = len(a) - idx
+				}
+				if idx >= 0 && idx < len(a) {
+					ret = append(ret, a[idx])
+				}
+			}
+		case stepWildcard:
+			switch v := value.(type) {
+			case map[string]interface{}:
+				for _, k := range sortedKeys(v) {
+					ret = append(ret, v[k])
+				}
+			case []interface{}:
+				ret = append(ret, v...)
+			}
+		case stepDescendants:
+			ret = descendants(ret, value)
+		}
+	}
+	return ret
+}
+
+// selectFrom returns the JSON of the value selected from the document. A
+// definite path selects null if the value does not exist. Otherwise the
+// selected values are returned as an array in which the members of objects
+// are in the order of their names. An empty document is treated as null.
+func (p *jsonPath) selectFrom(doc string) (string, error) {
+	var value interface{}
+	if doc != "" {
+		var err error
+		value, err = decodeJson(doc)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	values := []interface{}{value}
+	for i := range p.steps {
+		values = p.steps[i].apply(values)
+	}
+
+	var out json.RawMessage
+	var err error
+	switch {
+	case !p.definite:
+		out, err = encodeJson(values)
+	case len(values) == 0:
+		out = json.RawMessage("null")
+	default:
+		out, err = encodeJson(values[0])
+	}
+	return string(out), err
+}
+
+// Select returns the JSON of the value selected from the JSON document by
+// the JSON path. The path syntax is compatible with the json_extract
+// function of SQLite and supports also the wildcards * and .. of JSONPath.
+// If the path has wildcards, the selected values are returned as an array.
+func Select(doc string, path string) (string, error) {
+	p, err := parseJsonPath(path)
+	if err != nil {
+		return "", err
+	}
+	return p.selectFrom(doc)
+}
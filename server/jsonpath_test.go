@@ -0,0 +1,54 @@
+package jsondump
+
+import (
+	"testing"
+)
+
+func TestSelect(t *testing.T) {
+	doc := `{"a":{"b":[1,2,{"c":"d"}]},"e.f":3,"g h":[true,null],"n":1.50}`
+	tests := []struct {
+		name    string
+		doc     string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"Root", doc, `$`, doc, false},
+		{"Member", doc, `$.a`, `{"b":[1,2,{"c":"d"}]}`, false},
+		{"Nested members", doc, `$.a.b[2].c`, `"d"`, false},
+		{"Array index", doc, `$.a.b[0]`, `1`, false},
+		{"Index from the end", doc, `$.a.b[#-1]`, `{"c":"d"}`, false},
+		{"Negative index", doc, `$.a.b[-3]`, `1`, false},
+		{"Quoted member", doc, `$."e.f"`, `3`, false},
+		{"Bracketed member", doc, `$['g h'][0]`, `true`, false},
+		{"Double quoted bracketed member", doc, `$["e.f"]`, `3`, false},
+		{"Null value", doc, `$["g h"][1]`, `null`, false},
+		{"Numbers are kept", doc, `$.n`, `1.50`, false},
+		{"Missing member", doc, `$.x`, `null`, false},
+		{"Index out of range", doc, `$.a.b[3]`, `null`, false},
+		{"Index of an object", doc, `$.a[0]`, `null`, false},
+		{"Array wildcard", doc, `$.a.b[*]`, `[1,2,{"c":"d"}]`, false},
+		{"Member wildcard", `{"b":2,"a":1}`, `$.*`, `[1,2]`, false},
+		{"Wildcard without matches", doc, `$.x[*]`, `[]`, false},
+		{"Descendants", doc, `$..c`, `["d"]`, false},
+		{"Descendant indexes", `{"a":[1,2],"b":{"c":[3]}}`, `$..[0]`, `[1,3]`, false},
+		{"Empty document", ``, `$.a`, `null`, false},
+		{"Missing root", doc, `a.b`, ``, true},
+		{"Missing name", doc, `$.`, ``, true},
+		{"Missing bracket", doc, `$.a.b[0`, ``, true},
+		{"Invalid index", doc, `$.a.b[x]`, ``, true},
+		{"Zero index from the end", doc, `$.a.b[#-0]`, ``, true},
+		{"Unterminated quote", doc, `$."a`, ``, true},
+		{"Invalid document", `{`, `$`, ``, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Select(tt.doc, tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Select() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			_ = compare(t, "Select() not expected", tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package jsondump
+
+import (
+	"strings"
+	"time"
+)
+
+// ListQuery selects a page of the stored paths
+type ListQuery struct {
+	// Prefix limits the listing to the prefix and the paths below it
+	Prefix string
+
+	// After returns only the paths after it in ascending order
+	After string
+
+	// Limit is the maximum number of paths. Zero or negative means all.
+	Limit int
+}
+
+// PathInfo describes a stored path
+type PathInfo struct {
+	Path string
+
+	// Added is the time the oldest retained revision was added
+	Added time.Time
+
+	// Modified is the time the latest revision was added
+	Modified time.Time
+
+	// Revisions is the number of retained revisions
+	Revisions int
+
+	// Size is the length of the latest revision in bytes
+	Size int
+}
+
+// GetPathInfo returns the information of the path or nil if the path has no
+// content
+func GetPathInfo(s Store, path string) (*PathInfo, error) {
+	infos, err := s.ListPaths(&ListQuery{Prefix: path, Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) == 0 || infos[0].Path != path {
+		return nil, nil
+	}
+	return &infos[0], nil
+}
+
+// TreeEntry is a child of a directory-style listing. A folder has paths
+// below it and a dump has content. If a name is both, it is listed first
+// as a dump and then as a folder.
+type TreeEntry struct {
+	Name   string
+	Folder bool
+	Info   *PathInfo `json:",omitempty"`
+}
+
+// key returns the cursor of the entry. The keys of the entries are in the
+// same order as the paths.
+func (e *TreeEntry) key() string {
+	if e.Folder {
+		return e.Name + "/"
+	}
+	return e.Name
+}
+
+// afterSubtree is greater than the paths below the folder path when appended
+// to it
+const afterSubtree = "/\U0010FFFF"
+
+// ListTree lists the children of the prefix as folders and dumps. The paths
+// are split at the '/' characters. The after is the key of the last entry
+// of the previous page, i.e. the name of a dump or the name of a folder
+// followed by a '/'. Returns also the key of the last entry if there are
+// more entries.
+func ListTree(s Store, prefix, after string, limit int) ([]TreeEntry, string, error) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	base := ""
+	if prefix != "" {
+		base = prefix + "/"
+	}
+
+	cursor := ""
+	if after != "" {
+		cursor = base + after
+		if strings.HasSuffix(after, "/") {
+			cursor = base + strings.TrimSuffix(after, "/") + afterSubtree
+		}
+	}
+
+	// Get one extra entry to see if there are more
+	want := limit + 1
+	full := func(entries []TreeEntry) bool {
+		return limit > 0 && len(entries) >= want
+	}
+
+	ret := []TreeEntry{}
+	for !full(ret) {
+		q := &ListQuery{Prefix: prefix, After: cursor}
+		if limit > 0 {
+			q.Limit = want - len(ret)
+		}
+		infos, err := s.ListPaths(q)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(infos) == 0 {
+			break
+		}
+
+		for i := range infos {
+			path := infos[i].Path
+			cursor = path
+			if path == prefix {
+				continue
+			}
+
+			name := strings.TrimPrefix(path, base)
+			if idx := strings.IndexByte(name, '/'); idx >= 0 {
+				// Skip the rest of the folder
+				name = name[:idx]
+				ret = append(ret, TreeEntry{Name: name, Folder: true})
+				cursor = base + name + afterSubtree
+				break
+			}
+
+			ret = append(ret, TreeEntry{Name: name, Info: &infos[i]})
+			if full(ret) {
+				break
+			}
+		}
+	}
+
+	next := ""
+	if full(ret) {
+		ret = ret[:limit]
+		next = ret[limit-1].key()
+	}
+	return ret, next, nil
+}
@@ -0,0 +1,223 @@
+package jsondump
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kopoli/appkit"
+)
+
+// Level is the severity of a log message
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses one of debug, info, warn and error
+func ParseLevel(s string) (Level, error) {
+	for i := range levelNames {
+		if s == levelNames[i] {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("Unknown log level %q, expected one of %s", s,
+		strings.Join(levelNames, ", "))
+}
+
+// Logger writes log messages with key-value fields. Each message is a line
+// of text or a JSON object.
+type Logger struct {
+	out   io.Writer
+	level Level
+	json  bool
+
+	// Timestamps adds the time to the text messages. The JSON messages
+	// always have it.
+	Timestamps bool
+
+	now   func() time.Time
+	mutex sync.Mutex
+}
+
+// NewLogger creates a logger of the messages of the level and above. The
+// format is either text or json.
+func NewLogger(out io.Writer, level Level, format string) (*Logger, error) {
+	if format != "text" && format != "json" {
+		return nil, fmt.Errorf("Unknown log format %q, expected text or json", format)
+	}
+	return &Logger{
+		out:   out,
+		level: level,
+		json:  format == "json",
+		now:   time.Now,
+	}, nil
+}
+
+// loggerFromOptions creates the logger to stderr from the log-level,
+// log-format and log-timestamps options
+func loggerFromOptions(opts appkit.Options) (*Logger, error) {
+	level, err := ParseLevel(opts.Get("log-level", "info"))
+	if err != nil {
+		return nil, err
+	}
+	ret, err := NewLogger(os.Stderr, level, opts.Get("log-format", "text"))
+	if err != nil {
+		return nil, err
+	}
+	ret.Timestamps = opts.IsSet("log-timestamps")
+	return ret, nil
+}
+
+// fieldValue converts the value of a field to be encoded
+func fieldValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case error:
+		return val.Error()
+	case time.Duration:
+		return val.String()
+	case fmt.Stringer:
+		return val.String()
+	}
+	return v
+}
+
+// textValue formats the value of a field in the text format. Strings with
+// spaces or quotes are quoted.
+func textValue(v interface{}) string {
+	s := fmt.Sprint(fieldValue(v))
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// Log writes the message with the fields, which are alternating keys and
+// values
+func (l *Logger) Log(level Level, msg string, fields ...interface{}) {
+	if l == nil || level < l.level {
+		return
+	}
+
+	var b bytes.Buffer
+	now := l.now()
+	if l.json {
+		enc := func(v interface{}) {
+			js, err := json.Marshal(fieldValue(v))
+			if err != nil {
+				js, _ = json.Marshal(fmt.Sprint(v))
+			}
+			b.Write(js)
+		}
+
+		b.WriteString(`{"time":`)
+		enc(now.Format(time.RFC3339Nano))
+		b.WriteString(`,"level":`)
+		enc(level.String())
+		b.WriteString(`,"msg":`)
+		enc(msg)
+		for i := 0; i+1 < len(fields); i += 2 {
+			b.WriteString(",")
+			enc(fmt.Sprint(fields[i]))
+			b.WriteString(":")
+			enc(fields[i+1])
+		}
+		b.WriteString("}\n")
+	} else {
+		if l.Timestamps {
+			b.WriteString(now.Format("2006/01/02 15:04:05 "))
+		}
+		b.WriteString(strings.ToUpper(level.String()))
+		b.WriteString(" ")
+		b.WriteString(msg)
+		for i := 0; i+1 < len(fields); i += 2 {
+			fmt.Fprintf(&b, " %v=%s", fields[i], textValue(fields[i+1]))
+		}
+		b.WriteString("\n")
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, _ = l.out.Write(b.Bytes())
+}
+
+func (l *Logger) Debug(msg string, fields ...interface{}) {
+	l.Log(LevelDebug, msg, fields...)
+}
+
+func (l *Logger) Info(msg string, fields ...interface{}) {
+	l.Log(LevelInfo, msg, fields...)
+}
+
+func (l *Logger) Warn(msg string, fields ...interface{}) {
+	l.Log(LevelWarn, msg, fields...)
+}
+
+func (l *Logger) Error(msg string, fields ...interface{}) {
+	l.Log(LevelError, msg, fields...)
+}
+
+type requestIdContextKey struct{}
+
+// requestId returns the id of the request or an empty string
+func requestId(r *http.Request) string {
+	id, _ := r.Context().Value(requestIdContextKey{}).(string)
+	return id
+}
+
+// validRequestId checks that the id from a client is short and consists of
+// printable ASCII characters other than quotes and backslashes
+func validRequestId(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' || id[i] == '"' || id[i] == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIdHandler uses the X-Request-ID header of the request or a random
+// id as the id of the request and sets it to the X-Request-ID header of the
+// response
+func requestIdHandler() middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get("X-Request-ID")
+			if !validRequestId(id) {
+				b := make([]byte, 16)
+				_, _ = rand.Read(b)
+				id = hex.EncodeToString(b)
+			}
+
+			w.Header().Set("X-Request-ID", id)
+			ctx := context.WithValue(r.Context(), requestIdContextKey{}, id)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package jsondump
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kopoli/appkit"
+)
+
+func TestLogger(t *testing.T) {
+	at := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		format     string
+		level      Level
+		timestamps bool
+		want       []string
+	}{
+		{"Text", "text", LevelInfo, false, []string{
+			`INFO started address=:8032`,
+			`ERROR failed error="disk full" duration=1.5s`,
+		}},
+		{"Text with timestamps", "text", LevelError, true, []string{
+			`2021/03/01 12:00:00 ERROR failed error="disk full" duration=1.5s`,
+		}},
+		{"JSON", "json", LevelDebug, false, []string{
+			`{"time":"2021-03-01T12:00:00Z","level":"debug","msg":"details","count":2}`,
+			`{"time":"2021-03-01T12:00:00Z","level":"info","msg":"started","address":":8032"}`,
+			`{"time":"2021-03-01T12:00:00Z","level":"error","msg":"failed","error":"disk full","duration":"1.5s"}`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			l, err := NewLogger(&b, tt.level, tt.format)
+			if err != nil {
+				t.Fatalf("NewLogger() failed with error = %v", err)
+			}
+			l.Timestamps = tt.timestamps
+			l.now = func() time.Time { return at }
+
+			l.Debug("details", "count", 2)
+			l.Info("started", "address", ":8032")
+			l.Error("failed", "error", errors.New("disk full"), "duration", 1500*time.Millisecond)
+
+			got := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+			_ = compare(t, "Log not expected", tt.want, got)
+		})
+	}
+
+	_, err := NewLogger(&strings.Builder{}, LevelInfo, "xml")
+	if err == nil {
+		t.Errorf("NewLogger() with an unknown format should fail")
+	}
+	_, err = ParseLevel("verbose")
+	if err == nil {
+		t.Errorf("ParseLevel() of an unknown level should fail")
+	}
+}
+
+func TestRequestId(t *testing.T) {
+	h, _ := createHandler(NewMemStore(), appkit.NewOptions(), newMetrics(), newFeed(), nil)
+
+	request := func(id string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/a?id=x", nil)
+		if id != "" {
+			r.Header.Set("X-Request-ID", id)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request("abc-123")
+	_ = compare(t, "Request id not echoed", "abc-123", w.Header().Get("X-Request-ID"))
+	_ = compare(t, "Status not expected", http.StatusBadRequest, w.Code)
+	if !strings.Contains(w.Body.String(), `"request_id": "abc-123"`) {
+		t.Errorf("Error body does not have the request id: %s", w.Body.String())
+	}
+
+	for _, id := range []string{"", "with space", `"quoted"`, strings.Repeat("x", 129)} {
+		got := request(id).Header().Get("X-Request-ID")
+		if got == id || len(got) != 32 {
+			t.Errorf("Request id %q not replaced, got %q", id, got)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package jsondump
+
+// memStorage keeps the revisions in memory
+type memStorage struct {
+	data   map[string][]Content
+	lastId int
+}
+
+// NewMemStore creates a Store that keeps the data in memory
+func NewMemStore() Store {
+	return newGenericStore(&memStorage{
+		data: map[string][]Content{},
+	})
+}
+
+func (m *memStorage) paths() ([]string, error) {
+	ret := make([]string, 0, len(m.data))
+	for p := range m.data {
+		ret = append(ret, p)
+	}
+	return ret, nil
+}
+
+func (m *memStorage) revisions(path string) ([]Content, error) {
+	return append([]Content{}, m.data[path]...), nil
+}
+
+func (m *memStorage) nextId() (int, error) {
+	m.lastId++
+	return m.lastId, nil
+}
+
+func (m *memStorage) write(c *Content) error {
+	m.data[c.Path] = append(m.data[c.Path], *c)
+	return nil
+}
+
+func (m *memStorage) remove(path string, id int) error {
+	revs := m.data[path]
+	for i := range revs {
+		if revs[i].Id == id {
+			m.data[path] = append(revs[:i], revs[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *memStorage) removePath(path string) error {
+	delete(m.data, path)
+	return nil
+}
+
+func (m *memStorage) close() error {
+	return nil
+}
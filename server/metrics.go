@@ -0,0 +1,245 @@
+package jsondump
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sizer is implemented by the stores that can report the size of their
+// database
+type Sizer interface {
+	// Size returns the size of the database in bytes
+	Size() (int64, error)
+}
+
+// Counter is implemented by the stores that can count their contents
+// without reading them
+type Counter interface {
+	// Count returns the number of paths with content and the number of
+	// retained revisions
+	Count() (paths int64, revisions int64, err error)
+}
+
+// count returns the number of paths with content and revisions in the store
+func count(db Store) (int64, int64, error) {
+	if c, ok := db.(Counter); ok {
+		return c.Count()
+	}
+
+	paths, err := db.ListPaths(&ListQuery{})
+	if err != nil {
+		return 0, 0, err
+	}
+	var revisions int64
+	for i := range paths {
+		revisions += int64(paths[i].Revisions)
+	}
+	return int64(len(paths)), revisions, nil
+}
+
+// durationBuckets are the upper bounds of the latency histograms in seconds
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogram counts observations into durationBuckets
+type histogram struct {
+	// counts are the non-cumulative counts of the buckets and of +Inf
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(durationBuckets)+1)
+	}
+
+	i := sort.SearchFloat64s(durationBuckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// write writes the histogram in the Prometheus text format. The labels are
+// already formatted, e.g. `op="get"`.
+func (h *histogram) write(w io.Writer, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+
+	var cum uint64
+	for i, le := range durationBuckets {
+		cum += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep,
+			strconv.FormatFloat(le, 'g', -1, 64), cum)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+// writeHeader writes the help and type lines of a metric
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sortedHistograms returns the keys of the histograms in order
+func sortedHistograms(m map[string]*histogram) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// metrics collects the measurements of the web server
+type metrics struct {
+	mutex sync.Mutex
+
+	// requests by the method and code labels
+	requests map[string]*histogram
+
+	// dbOps by the op label
+	dbOps map[string]*histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: map[string]*histogram{},
+		dbOps:    map[string]*histogram{},
+	}
+}
+
+// requestMethod returns the method label of the request. The unknown
+// methods are grouped together.
+func requestMethod(method string) string {
+	switch method {
+	case "GET", "HEAD", "PUT", "PATCH", "POST", "DELETE", "OPTIONS":
+		return method
+	}
+	return "other"
+}
+
+func (m *metrics) observeRequest(method string, code int, dur time.Duration) {
+	if code == 0 {
+		// Written without calling WriteHeader
+		code = http.StatusOK
+	}
+	labels := fmt.Sprintf(`method="%s",code="%d"`, requestMethod(method), code)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	h, ok := m.requests[labels]
+	if !ok {
+		h = &histogram{}
+		m.requests[labels] = h
+	}
+	h.observe(dur.Seconds())
+}
+
+func (m *metrics) observeDb(op string, dur time.Duration) {
+	labels := fmt.Sprintf(`op="%s"`, op)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	h, ok := m.dbOps[labels]
+	if !ok {
+		h = &histogram{}
+		m.dbOps[labels] = h
+	}
+	h.observe(dur.Seconds())
+}
+
+// write writes the collected metrics and the current state of the store in
+// the Prometheus text format
+func (m *metrics) write(w io.Writer, db Store) error {
+	// Read the store first to not hold the mutex during the queries
+	paths, revisions, err := count(db)
+	if err != nil {
+		return err
+	}
+
+	size := int64(-1)
+	if s, ok := db.(Sizer); ok {
+		size, err = s.Size()
+		if err != nil {
+			return err
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	name := "jsondump_http_requests_total"
+	writeHeader(w, name, "counter", "Number of HTTP requests by method and status code.")
+	for _, labels := range sortedHistograms(m.requests) {
+		fmt.Fprintf(w, "%s{%s} %d\n", name, labels, m.requests[labels].count)
+	}
+
+	name = "jsondump_http_request_duration_seconds"
+	writeHeader(w, name, "histogram", "Duration of HTTP requests by method and status code.")
+	for _, labels := range sortedHistograms(m.requests) {
+		m.requests[labels].write(w, name, labels)
+	}
+
+	name = "jsondump_db_operation_duration_seconds"
+	writeHeader(w, name, "histogram", "Duration of the database operations of the requests.")
+	for _, labels := range sortedHistograms(m.dbOps) {
+		m.dbOps[labels].write(w, name, labels)
+	}
+
+	if size >= 0 {
+		name = "jsondump_db_size_bytes"
+		writeHeader(w, name, "gauge", "Size of the database.")
+		fmt.Fprintf(w, "%s %d\n", name, size)
+	}
+
+	name = "jsondump_paths"
+	writeHeader(w, name, "gauge", "Number of paths with content.")
+	fmt.Fprintf(w, "%s %d\n", name, paths)
+
+	name = "jsondump_revisions"
+	writeHeader(w, name, "gauge", "Number of retained revisions.")
+	fmt.Fprintf(w, "%s %d\n", name, revisions)
+
+	name = "jsondump_retention_removed_revisions_total"
+	writeHeader(w, name, "counter", "Number of revisions removed by the retention rules.")
+	fmt.Fprintf(w, "%s %d\n", name, db.Retention().Removed())
+
+	return nil
+}
+
+// metricsHandler records the requests to the metrics
+func metricsHandler(m *metrics) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			cw := &CodeResponseWriter{w, 0, 0}
+			next.ServeHTTP(cw, r)
+			m.observeRequest(r.Method, cw.Code, time.Since(start))
+		})
+	}
+}
+
+// serveMetrics serves the metrics of the store
+func serveMetrics(m *metrics, db Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var b strings.Builder
+		err := m.write(&b, db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = io.WriteString(w, b.String())
+	}
+}
@@ -0,0 +1,160 @@
+package jsondump
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kopoli/appkit"
+)
+
+func TestHistogram(t *testing.T) {
+	var h histogram
+	h.observe(0.001)
+	h.observe(0.005)
+	h.observe(0.3)
+	h.observe(20)
+
+	var b strings.Builder
+	h.write(&b, "x", `op="a"`)
+	want := []string{
+		`x_bucket{op="a",le="0.005"} 2`,
+		`x_bucket{op="a",le="0.01"} 2`,
+		`x_bucket{op="a",le="0.025"} 2`,
+		`x_bucket{op="a",le="0.05"} 2`,
+		`x_bucket{op="a",le="0.1"} 2`,
+		`x_bucket{op="a",le="0.25"} 2`,
+		`x_bucket{op="a",le="0.5"} 3`,
+		`x_bucket{op="a",le="1"} 3`,
+		`x_bucket{op="a",le="2.5"} 3`,
+		`x_bucket{op="a",le="5"} 3`,
+		`x_bucket{op="a",le="10"} 3`,
+		`x_bucket{op="a",le="+Inf"} 4`,
+		`x_sum{op="a"} 20.306`,
+		`x_count{op="a"} 4`,
+		``,
+	}
+	_ = compare(t, "Histogram not expected", want, strings.Split(b.String(), "\n"))
+}
+
+func TestMetrics(t *testing.T) {
+	db := NewMemStore()
+	db.Retention().MaxVersions = 1
+	db.Retention().ReplaceInterval = 0
+
+	m := newMetrics()
+	opts := appkit.NewOptions()
+	api, _ := createHandler(db, opts, m, newFeed(), nil)
+	admin := createAdminHandler(db, opts, m, nil)
+
+	request := func(method, path, body string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	}
+
+	request("PUT", "/api/a", `1`)
+	time.Sleep(time.Millisecond)
+	request("PUT", "/api/a", `2`)
+	request("PUT", "/api/b/c", `3`)
+	request("GET", "/api/a", "")
+	request("PUT", "/api/a", `{`)
+	request("BREW", "/api/a", "")
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	_ = compare(t, "Status not expected", 200, w.Code)
+
+	lines := map[string]bool{}
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		lines[line] = true
+	}
+
+	for _, want := range []string{
+		`# TYPE jsondump_http_requests_total counter`,
+		`jsondump_http_requests_total{method="PUT",code="200"} 3`,
+		`jsondump_http_requests_total{method="PUT",code="400"} 1`,
+		`jsondump_http_requests_total{method="GET",code="200"} 1`,
+		`jsondump_http_requests_total{method="other",code="400"} 1`,
+		`# TYPE jsondump_http_request_duration_seconds histogram`,
+		`jsondump_http_request_duration_seconds_count{method="PUT",code="200"} 3`,
+		`jsondump_db_operation_duration_seconds_count{op="update"} 3`,
+		`jsondump_db_operation_duration_seconds_count{op="get"} 1`,
+		`jsondump_paths 2`,
+		`jsondump_revisions 2`,
+		`jsondump_retention_removed_revisions_total 1`,
+	} {
+		if !lines[want] {
+			t.Errorf("Metrics do not contain %q:\n%s", want, w.Body.String())
+		}
+	}
+	if strings.Contains(w.Body.String(), "jsondump_db_size_bytes") {
+		t.Errorf("Size reported for a store without Sizer")
+	}
+}
+
+func TestDbSize(t *testing.T) {
+	_ = os.Remove(dbfile)
+	db, err := CreateDb(dbfile, context.TODO())
+	if err != nil {
+		t.Fatalf("Setting up db failed with error = %v", err)
+	}
+	defer db.Close()
+
+	before, err := db.Size()
+	if err == nil {
+		err = db.Add("a", strings.Repeat("x", 100000))
+	}
+	if err != nil {
+		t.Fatalf("Size() failed with error = %v", err)
+	}
+	after, err := db.Size()
+	if err != nil {
+		t.Fatalf("Size() failed with error = %v", err)
+	}
+	if before <= 0 || after <= before {
+		t.Errorf("Size() = %d before and %d after adding content", before, after)
+	}
+}
+
+func TestCount(t *testing.T) {
+	_ = os.Remove(dbfile)
+	db, err := CreateDb(dbfile, context.TODO())
+	if err != nil {
+		t.Fatalf("Setting up db failed with error = %v", err)
+	}
+	defer db.Close()
+
+	stores := []struct {
+		name string
+		db   Store
+	}{
+		{"Db", db},
+		{"Memory", NewMemStore()},
+	}
+	for _, tt := range stores {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.db.Retention().ReplaceInterval = 0
+			err := tt.db.Add("a", `"1"`)
+			if err == nil {
+				err = tt.db.Add("a", `"2"`)
+			}
+			if err == nil {
+				err = tt.db.Add("b/c", `"3"`)
+			}
+			if err != nil {
+				t.Fatalf("Adding content failed with error = %v", err)
+			}
+
+			paths, revisions, err := count(tt.db)
+			if err != nil {
+				t.Fatalf("count() failed with error = %v", err)
+			}
+			_ = compare(t, "count() not expected", []int64{2, 3},
+				[]int64{paths, revisions})
+		})
+	}
+}
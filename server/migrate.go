@@ -0,0 +1,82 @@
+package jsondump
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrations are the changes to the database schema in order. The
+// user_version of the database is the number of applied migrations.
+var migrations = []string{
+	// 1: Initial schema
+	`
+CREATE TABLE IF NOT EXISTS dump (
+  id INTEGER PRIMARY KEY ASC AUTOINCREMENT,
+  path TEXT DEFAULT "" NOT NULL UNIQUE ON CONFLICT ABORT
+);
+
+CREATE TABLE IF NOT EXISTS content (
+  id INTEGER PRIMARY KEY ASC AUTOINCREMENT,
+  text DEFAULT "" NOT NULL,
+  added DATETIME NOT NULL,
+  dumpid INTEGER REFERENCES dump(id) NOT NULL
+);
+`,
+	// 2: Index for getting the revisions of a path in order
+	`
+CREATE INDEX IF NOT EXISTS content_dumpid_added ON content(dumpid, added);
+`,
+	// 3: API tokens
+	`
+CREATE TABLE IF NOT EXISTS token (
+  id INTEGER PRIMARY KEY ASC AUTOINCREMENT,
+  name TEXT DEFAULT "" NOT NULL,
+  hash TEXT NOT NULL UNIQUE,
+  prefix TEXT DEFAULT "" NOT NULL,
+  permissions TEXT DEFAULT "" NOT NULL,
+  created DATETIME NOT NULL
+);
+`,
+}
+
+// SchemaVersion returns the schema version of the database
+func (db *Db) SchemaVersion() (int, error) {
+	var version int
+	err := db.db.QueryRowContext(db.ctx, "PRAGMA user_version;").Scan(&version)
+	return version, err
+}
+
+// migrate applies the migrations missing from the database. Each migration
+// is applied in its own transaction.
+func (db *Db) migrate() error {
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	if version > len(migrations) {
+		return fmt.Errorf("Database schema version %d is newer than the supported %d",
+			version, len(migrations))
+	}
+
+	for ; version < len(migrations); version++ {
+		next := version + 1
+		err = db.transaction(func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(db.ctx, migrations[version])
+			if err != nil {
+				return err
+			}
+
+			// PRAGMA does not support parameters
+			_, err = tx.ExecContext(db.ctx,
+				fmt.Sprintf("PRAGMA user_version=%d;", next))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Migrating database to version %d failed: %v",
+				next, err)
+		}
+	}
+
+	return nil
+}
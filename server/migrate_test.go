@@ -0,0 +1,184 @@
+package jsondump
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+)
+
+// schemaV1 is the schema of the databases before the migrations
+const schemaV1 = `
+CREATE TABLE IF NOT EXISTS dump (
+  id INTEGER PRIMARY KEY ASC AUTOINCREMENT,
+  path TEXT DEFAULT "" NOT NULL UNIQUE ON CONFLICT ABORT
+);
+
+CREATE TABLE IF NOT EXISTS content (
+  id INTEGER PRIMARY KEY ASC AUTOINCREMENT,
+  text DEFAULT "" NOT NULL,
+  added DATETIME NOT NULL,
+  dumpid INTEGER REFERENCES dump(id) NOT NULL
+);
+
+PRAGMA busy_timeout=10000;
+PRAGMA user_version=1;
+
+INSERT INTO dump(path) VALUES ("/old");
+INSERT INTO content(text, added, dumpid)
+VALUES ("content", "2021-03-01 12:00:00+00:00", 1);
+`
+
+// createRawDb creates a database file by running the setup SQL
+func createRawDb(t *testing.T, setup string) bool {
+	_ = os.Remove(dbfile)
+	d, err := sql.Open("sqlite3", "file:"+dbfile)
+	if err != nil {
+		t.Errorf("Opening raw db failed with error = %v", err)
+		return false
+	}
+	defer d.Close()
+
+	_, err = d.Exec(setup)
+	if err != nil {
+		t.Errorf("Setting up raw db failed with error = %v", err)
+		return false
+	}
+	return true
+}
+
+func hasIndex(t *testing.T, db *Db, name string) bool {
+	var count int
+	err := db.db.QueryRow(`SELECT count(*) FROM sqlite_master
+WHERE type = "index" AND name = ?;`, name).Scan(&count)
+	if err != nil {
+		t.Errorf("Querying indexes failed with error = %v", err)
+	}
+	return count == 1
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.TODO()
+
+	t.Run("New database", func(t *testing.T) {
+		_ = os.Remove(dbfile)
+		db, err := CreateDb(dbfile, ctx)
+		if err != nil {
+			t.Errorf("CreateDb() error = %v", err)
+			return
+		}
+		defer db.Close()
+
+		version, err := db.SchemaVersion()
+		if err != nil {
+			t.Errorf("SchemaVersion() error = %v", err)
+			return
+		}
+		_ = compare(t, "Schema version not expected", len(migrations), version)
+		if !hasIndex(t, db, "content_dumpid_added") {
+			t.Errorf("Index not created")
+		}
+	})
+
+	t.Run("Upgrade from version 1", func(t *testing.T) {
+		if !createRawDb(t, schemaV1) {
+			return
+		}
+
+		db, err := CreateDb(dbfile, ctx)
+		if err != nil {
+			t.Errorf("CreateDb() error = %v", err)
+			return
+		}
+		defer db.Close()
+
+		version, err := db.SchemaVersion()
+		if err != nil {
+			t.Errorf("SchemaVersion() error = %v", err)
+			return
+		}
+		_ = compare(t, "Schema version not expected", len(migrations), version)
+		if !hasIndex(t, db, "content_dumpid_added") {
+			t.Errorf("Index not created")
+		}
+
+		c, err := db.GetContent("/old", false, 1)
+		if err != nil {
+			t.Errorf("GetContent() error = %v", err)
+			return
+		}
+		if len(c) != 1 || c[0].Text != "content" {
+			t.Errorf("Content not preserved: %v", c)
+		}
+
+		err = db.Add("/old", "new")
+		if err != nil {
+			t.Errorf("Add() error = %v", err)
+		}
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		_ = os.Remove(dbfile)
+		for i := 0; i < 2; i++ {
+			db, err := CreateDb(dbfile, ctx)
+			if err != nil {
+				t.Errorf("CreateDb() no.%d error = %v", i, err)
+				return
+			}
+			_ = db.Close()
+		}
+	})
+
+	t.Run("Newer version is refused", func(t *testing.T) {
+		if !createRawDb(t, schemaV1+"PRAGMA user_version=1000;") {
+			return
+		}
+
+		db, err := CreateDb(dbfile, ctx)
+		if err == nil {
+			_ = db.Close()
+			t.Errorf("CreateDb() succeeded for a newer database")
+		}
+	})
+
+	t.Run("Failed migration is rolled back", func(t *testing.T) {
+		if !createRawDb(t, schemaV1) {
+			return
+		}
+
+		orig := migrations
+		defer func() { migrations = orig }()
+		migrations = append(append([]string{}, orig...),
+			`CREATE TABLE extra (id INTEGER);
+INSERT INTO nonexistent VALUES (1);`)
+
+		db, err := CreateDb(dbfile, ctx)
+		if err == nil {
+			_ = db.Close()
+			t.Errorf("CreateDb() succeeded with a failing migration")
+			return
+		}
+
+		migrations = orig
+		db, err = CreateDb(dbfile, ctx)
+		if err != nil {
+			t.Errorf("CreateDb() error = %v", err)
+			return
+		}
+		defer db.Close()
+
+		version, err := db.SchemaVersion()
+		if err != nil {
+			t.Errorf("SchemaVersion() error = %v", err)
+			return
+		}
+		_ = compare(t, "Schema version not expected", len(orig), version)
+
+		var count int
+		err = db.db.QueryRow(`SELECT count(*) FROM sqlite_master
+WHERE name = "extra";`).Scan(&count)
+		if err != nil || count != 0 {
+			t.Errorf("Failed migration not rolled back: %d %v", count, err)
+		}
+	})
+}
@@ -0,0 +1,630 @@
+package jsondump
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// pgMigrations are the changes to the PostgreSQL schema in order. The
+// version of the database is the number of applied migrations.
+var pgMigrations = []string{
+	// 1: Initial schema
+	`
+CREATE TABLE IF NOT EXISTS dump (
+  id BIGSERIAL PRIMARY KEY,
+  path TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS content (
+  id BIGSERIAL PRIMARY KEY,
+  text TEXT NOT NULL DEFAULT '',
+  added TIMESTAMPTZ NOT NULL,
+  dumpid BIGINT NOT NULL REFERENCES dump(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS content_dumpid_added ON content(dumpid, added);
+`,
+	// 2: API tokens
+	`
+CREATE TABLE IF NOT EXISTS token (
+  id BIGSERIAL PRIMARY KEY,
+  name TEXT NOT NULL DEFAULT '',
+  hash TEXT NOT NULL UNIQUE,
+  prefix TEXT NOT NULL DEFAULT '',
+  permissions TEXT NOT NULL DEFAULT '',
+  created TIMESTAMPTZ NOT NULL
+);
+`,
+}
+
+// PgStore is a Store in a PostgreSQL database. Several instances can use
+// the same database concurrently.
+type PgStore struct {
+	db        *sql.DB
+	ctx       context.Context
+	now       func() time.Time
+	retention RetentionPolicy
+}
+
+// CreatePgStore connects to the PostgreSQL database with the dsn and
+// migrates its schema
+func CreatePgStore(dsn string, ctx context.Context) (*PgStore, error) {
+	d, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &PgStore{
+		db:  d,
+		ctx: ctx,
+		now: time.Now,
+		retention: RetentionPolicy{
+			MaxVersions:     defaultVersions,
+			ReplaceInterval: replaceInterval,
+		},
+	}
+
+	err = ret.migrate()
+	if err != nil {
+		_ = d.Close()
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// migrate applies the missing migrations. The migrating instance holds an
+// advisory lock so that concurrently starting instances wait for it.
+func (s *PgStore) migrate() error {
+	return s.transaction(func(tx *sql.Tx) error {
+		queries := []string{
+			`SELECT pg_advisory_xact_lock(2932);`,
+			`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL);`,
+			`INSERT INTO schema_version(version)
+SELECT 0 WHERE NOT EXISTS (SELECT 1 FROM schema_version);`,
+		}
+		for _, query := range queries {
+			_, err := tx.ExecContext(s.ctx, query)
+			if err != nil {
+				return err
+			}
+		}
+
+		var version int
+		err := tx.QueryRowContext(s.ctx,
+			`SELECT version FROM schema_version;`).Scan(&version)
+		if err != nil {
+			return err
+		}
+
+		if version > len(pgMigrations) {
+			return fmt.Errorf("Database schema version %d is newer than the supported %d",
+				version, len(pgMigrations))
+		}
+
+		for ; version < len(pgMigrations); version++ {
+			_, err = tx.ExecContext(s.ctx, pgMigrations[version])
+			if err != nil {
+				return fmt.Errorf("Migrating database to version %d failed: %v",
+					version+1, err)
+			}
+		}
+
+		_, err = tx.ExecContext(s.ctx, `UPDATE schema_version SET version = $1;`,
+			version)
+		return err
+	})
+}
+
+// SchemaVersion returns the schema version of the database
+func (s *PgStore) SchemaVersion() (int, error) {
+	var version int
+	err := s.db.QueryRowContext(s.ctx,
+		`SELECT version FROM schema_version;`).Scan(&version)
+	return version, err
+}
+
+func (s *PgStore) transaction(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(s.ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PgStore) query(query string, handleRow func(*sql.Rows) error,
+	args ...interface{}) error {
+
+	rows, err := s.db.QueryContext(s.ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		err = handleRow(rows)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *PgStore) Retention() *RetentionPolicy {
+	return &s.retention
+}
+
+// lockPath creates the path if needed and locks it until the end of the
+// transaction. Returns the id of the path.
+func (s *PgStore) lockPath(tx *sql.Tx, path string) (int64, error) {
+	_, err := tx.ExecContext(s.ctx, `
+INSERT INTO dump(path) VALUES ($1) ON CONFLICT (path) DO NOTHING;`, path)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int64
+	err = tx.QueryRowContext(s.ctx, `
+SELECT id FROM dump WHERE path = $1 FOR UPDATE;`, path).Scan(&id)
+	return id, err
+}
+
+// lockExisting locks the path until the end of the transaction if it
+// exists. Returns the id of the path and whether it exists.
+func (s *PgStore) lockExisting(tx *sql.Tx, path string) (int64, bool, error) {
+	var id int64
+	err := tx.QueryRowContext(s.ctx, `
+SELECT id FROM dump WHERE path = $1 FOR UPDATE;`, path).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return id, err == nil, err
+}
+
+// revisions lists the revisions of the path newest first without the texts
+func (s *PgStore) revisions(tx *sql.Tx, dumpid int64) ([]Content, error) {
+	rows, err := tx.QueryContext(s.ctx, `
+SELECT id, added FROM content
+WHERE dumpid = $1
+ORDER BY added DESC, id DESC;`, dumpid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := []Content{}
+	for rows.Next() {
+		var c Content
+		err = rows.Scan(&c.Id, &c.Date)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, c)
+	}
+	return ret, rows.Err()
+}
+
+// trim removes the revisions of the locked path according to the retention
+// policy. Returns the number of removed revisions.
+func (s *PgStore) trim(tx *sql.Tx, dumpid int64, policy Retention, now time.Time) (int64, error) {
+	revs, err := s.revisions(tx, dumpid)
+	if err != nil {
+		return 0, err
+	}
+
+	ids := expired(revs, policy, now)
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	res, err := tx.ExecContext(s.ctx, `
+DELETE FROM content WHERE id = ANY($1);`, pq.Array(ids))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err == nil {
+		s.retention.countRemoved(n)
+	}
+	return n, err
+}
+
+func (s *PgStore) latest(tx *sql.Tx, path string) (*Content, error) {
+	var c Content
+	err := tx.QueryRowContext(s.ctx, `
+SELECT content.id, content.text, content.added, dump.path
+FROM content, dump
+WHERE dump.path = $1 AND dump.id = content.dumpid
+ORDER BY content.added DESC, content.id DESC
+LIMIT 1;`, path).Scan(&c.Id, &c.Text, &c.Date, &c.Path)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *PgStore) add(tx *sql.Tx, dumpid int64, path, content string) (*Content, error) {
+	policy := s.retention.lookup(path)
+	added := s.now()
+	from := added.Add(-policy.ReplaceInterval)
+
+	_, err := tx.ExecContext(s.ctx, `
+-- Delete content that is in the replace interval in second precision
+DELETE FROM content
+WHERE dumpid = $1 AND
+  floor(extract(epoch FROM added)) > floor(extract(epoch FROM $2::timestamptz)) AND
+  floor(extract(epoch FROM added)) <= floor(extract(epoch FROM $3::timestamptz));`,
+		dumpid, from, added)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Content{
+		Path: path,
+		Text: content,
+		Date: added,
+	}
+	err = tx.QueryRowContext(s.ctx, `
+INSERT INTO content(text, added, dumpid) VALUES ($1, $2, $3) RETURNING id;`,
+		content, added, dumpid).Scan(&c.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.trim(tx, dumpid, policy, added)
+	return c, err
+}
+
+func (s *PgStore) Add(path, content string) error {
+	_, err := s.Update(path, func(*Content) (string, error) {
+		return content, nil
+	})
+	return err
+}
+
+func (s *PgStore) Update(path string, fn func(cur *Content) (string, error)) (*Content, error) {
+	var ret *Content
+	err := s.transaction(func(tx *sql.Tx) error {
+		dumpid, err := s.lockPath(tx, path)
+		if err != nil {
+			return err
+		}
+
+		cur, err := s.latest(tx, path)
+		if err != nil {
+			return err
+		}
+
+		content, err := fn(cur)
+		if err != nil {
+			return err
+		}
+
+		ret, err = s.add(tx, dumpid, path, content)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// pgPathArgs returns the arguments for matching the path and optionally the
+// paths below it with the pgPathMatch condition
+func pgPathArgs(path string, recursive bool) []interface{} {
+	if recursive {
+		path = strings.TrimSuffix(path, "/")
+	}
+	return []interface{}{path, recursive, subtreePattern(path)}
+}
+
+const pgPathMatch = `(dump.path = $1 OR ($2 AND dump.path LIKE $3 ESCAPE '\'))`
+
+// deletePaths removes the path and optionally the paths below it in the
+// transaction
+func (s *PgStore) deletePaths(tx *sql.Tx, path string, recursive bool) error {
+	_, err := tx.ExecContext(s.ctx, `
+DELETE FROM dump WHERE `+pgPathMatch+`;`, pgPathArgs(path, recursive)...)
+	return err
+}
+
+func (s *PgStore) Delete(path string, recursive bool) error {
+	return s.transaction(func(tx *sql.Tx) error {
+		return s.deletePaths(tx, path, recursive)
+	})
+}
+
+func (s *PgStore) DeleteIf(path string, recursive bool, fn func(cur *Content) error) (*Content, error) {
+	var ret *Content
+	err := s.transaction(func(tx *sql.Tx) error {
+		// Locking serializes the check with the concurrent writes of the
+		// path. The locked row is removed with the path.
+		_, err := s.lockPath(tx, path)
+		if err != nil {
+			return err
+		}
+
+		ret, err = s.latest(tx, path)
+		if err != nil {
+			return err
+		}
+
+		err = fn(ret)
+		if err != nil {
+			return err
+		}
+
+		return s.deletePaths(tx, path, recursive)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (s *PgStore) GetPaths() ([]string, error) {
+	ret := []string{}
+	row := func(rows *sql.Rows) error {
+		var path string
+		err := rows.Scan(&path)
+		if err != nil {
+			return err
+		}
+		ret = append(ret, path)
+		return nil
+	}
+
+	err := s.query(`SELECT path FROM dump
+WHERE EXISTS (SELECT 1 FROM content WHERE content.dumpid = dump.id)
+ORDER BY path COLLATE "C" ASC;`, row)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (s *PgStore) ListPaths(q *ListQuery) ([]PathInfo, error) {
+	ret := []PathInfo{}
+	row := func(rows *sql.Rows) error {
+		var p PathInfo
+		err := rows.Scan(&p.Path, &p.Added, &p.Modified, &p.Revisions, &p.Size)
+		if err != nil {
+			return err
+		}
+		ret = append(ret, p)
+		return nil
+	}
+
+	var limit interface{}
+	if q.Limit > 0 {
+		limit = q.Limit
+	}
+
+	args := append(pgPathArgs(q.Prefix, true), q.After, limit)
+	err := s.query(`
+SELECT dump.path, first.added, latest.added,
+       (SELECT count(*) FROM content WHERE content.dumpid = dump.id),
+       octet_length(latest.text)
+FROM (
+  -- The page of paths that have content
+  SELECT id, path FROM dump
+  WHERE `+pgPathMatch+` AND
+    path COLLATE "C" > $4 AND
+    EXISTS (SELECT 1 FROM content WHERE content.dumpid = dump.id)
+  ORDER BY path COLLATE "C"
+  LIMIT $5) AS dump,
+  LATERAL (
+    SELECT added, text FROM content WHERE content.dumpid = dump.id
+    ORDER BY added DESC, id DESC LIMIT 1) AS latest,
+  LATERAL (
+    SELECT added FROM content WHERE content.dumpid = dump.id
+    ORDER BY added ASC, id ASC LIMIT 1) AS first
+ORDER BY dump.path COLLATE "C";`, row, args...)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// getContent runs the query that returns id, text, added and path columns
+func (s *PgStore) getContent(query string, args ...interface{}) ([]Content, error) {
+	ret := []Content{}
+
+	row := func(rows *sql.Rows) error {
+		var c Content
+		err := rows.Scan(&c.Id, &c.Text, &c.Date, &c.Path)
+		if err != nil {
+			return err
+		}
+		ret = append(ret, c)
+		return nil
+	}
+
+	err := s.query(query, row, args...)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (s *PgStore) GetContent(path string, recursive bool, numLatest int) ([]Content, error) {
+	query := `
+SELECT id, text, added, path FROM (
+  -- Add row numbers to the rows in groups partitioned by different paths
+  SELECT content.id, content.text, content.added, dump.path,
+         row_number() OVER (PARTITION BY dump.path
+                            ORDER BY content.added DESC, content.id DESC) AS count
+  FROM content, dump
+  WHERE ` + pgPathMatch + ` AND dump.id = content.dumpid) AS revisions
+-- if the row number is too high (i.e. too old version)
+WHERE $4 < 0 OR count <= $4
+ORDER BY path COLLATE "C", added DESC, id DESC;
+`
+	args := append(pgPathArgs(path, recursive), numLatest)
+	return s.getContent(query, args...)
+}
+
+func (s *PgStore) GetContentAt(path string, recursive bool, at time.Time) ([]Content, error) {
+	query := `
+SELECT id, text, added, path FROM (
+  SELECT content.id, content.text, content.added, dump.path,
+         row_number() OVER (PARTITION BY dump.path
+                            ORDER BY content.added DESC, content.id DESC) AS count
+  FROM content, dump
+  WHERE ` + pgPathMatch + ` AND dump.id = content.dumpid AND
+    date_trunc('milliseconds', content.added) <= date_trunc('milliseconds', $4::timestamptz))
+  AS revisions
+WHERE count = 1
+ORDER BY path COLLATE "C";
+`
+	args := append(pgPathArgs(path, recursive), at)
+	return s.getContent(query, args...)
+}
+
+func (s *PgStore) GetHistory(path string) ([]Revision, error) {
+	ret := []Revision{}
+
+	row := func(rows *sql.Rows) error {
+		var r Revision
+		err := rows.Scan(&r.Id, &r.Date, &r.Path)
+		if err != nil {
+			return err
+		}
+		ret = append(ret, r)
+		return nil
+	}
+
+	err := s.query(`
+SELECT content.id, content.added, dump.path
+FROM content, dump
+WHERE dump.path = $1 AND dump.id = content.dumpid
+ORDER BY content.added DESC, content.id DESC;`, row, path)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (s *PgStore) GetRevision(path string, id int) ([]Content, error) {
+	return s.getContent(`
+SELECT content.id, content.text, content.added, dump.path
+FROM content, dump
+WHERE dump.path = $1 AND dump.id = content.dumpid AND content.id = $2;`,
+		path, id)
+}
+
+func (s *PgStore) Compact() (int64, error) {
+	paths, err := s.GetPaths()
+	if err != nil {
+		return 0, err
+	}
+
+	var ret int64
+	now := s.now()
+	for _, path := range paths {
+		policy := s.retention.lookup(path)
+		err = s.transaction(func(tx *sql.Tx) error {
+			// The path may have been deleted after listing
+			dumpid, ok, err := s.lockExisting(tx, path)
+			if err != nil || !ok {
+				return err
+			}
+			n, err := s.trim(tx, dumpid, policy, now)
+			ret += n
+			return err
+		})
+		if err != nil {
+			return ret, err
+		}
+	}
+
+	return ret, nil
+}
+
+func (s *PgStore) AddToken(t *Token, hash string) (int, error) {
+	var id int
+	err := s.db.QueryRowContext(s.ctx, `
+INSERT INTO token(name, hash, prefix, permissions, created)
+VALUES ($1, $2, $3, $4, $5) RETURNING id;`,
+		t.Name, hash, t.Prefix, t.Permissions, t.Created).Scan(&id)
+	return id, err
+}
+
+func (s *PgStore) RemoveToken(id int) error {
+	res, err := s.db.ExecContext(s.ctx, `DELETE FROM token WHERE id = $1;`, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		err = fmt.Errorf("Token %d not found", id)
+	}
+	return err
+}
+
+// getTokens runs the query that returns the token columns
+func (s *PgStore) getTokens(query string, args ...interface{}) ([]Token, error) {
+	ret := []Token{}
+	row := func(rows *sql.Rows) error {
+		var t Token
+		err := rows.Scan(&t.Id, &t.Name, &t.Prefix, &t.Permissions, &t.Created)
+		if err != nil {
+			return err
+		}
+		ret = append(ret, t)
+		return nil
+	}
+
+	err := s.query(query, row, args...)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (s *PgStore) GetTokens() ([]Token, error) {
+	return s.getTokens(`
+SELECT id, name, prefix, permissions, created FROM token ORDER BY id;`)
+}
+
+func (s *PgStore) GetToken(hash string) (*Token, error) {
+	t, err := s.getTokens(`
+SELECT id, name, prefix, permissions, created FROM token WHERE hash = $1;`, hash)
+	if err != nil || len(t) == 0 {
+		return nil, err
+	}
+	return &t[0], nil
+}
+
+func (s *PgStore) Size() (int64, error) {
+	var ret int64
+	err := s.db.QueryRowContext(s.ctx, `
+SELECT pg_database_size(current_database());`).Scan(&ret)
+	return ret, err
+}
+
+func (s *PgStore) Count() (int64, int64, error) {
+	var paths, revisions int64
+	err := s.db.QueryRowContext(s.ctx, `
+SELECT COUNT(DISTINCT dumpid), COUNT(*) FROM content;`).Scan(&paths, &revisions)
+	return paths, revisions, err
+}
+
+func (s *PgStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,228 @@
+package jsondump
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// postgresImage is the image of the database container for the tests
+const postgresImage = "postgres:16-alpine"
+
+var postgres struct {
+	once      sync.Once
+	dsn       string
+	container string
+	err       error
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if postgres.container != "" {
+		_ = exec.Command("docker", "rm", "-f", postgres.container).Run()
+	}
+	os.Exit(code)
+}
+
+// startPostgres starts a database in a container and waits until it accepts
+// connections. Returns the DSN of the database.
+func startPostgres() (string, error) {
+	out, err := exec.Command("docker", "run", "-d", "--rm",
+		"-e", "POSTGRES_PASSWORD=jsondump", "-e", "POSTGRES_DB=jsondump",
+		"-p", "127.0.0.1::5432", postgresImage).Output()
+	if err != nil {
+		return "", fmt.Errorf("Starting the container failed: %v", err)
+	}
+	postgres.container = strings.TrimSpace(string(out))
+
+	out, err = exec.Command("docker", "port", postgres.container, "5432/tcp").Output()
+	if err != nil {
+		return "", fmt.Errorf("Getting the port of the container failed: %v", err)
+	}
+	addr := strings.Fields(string(out))
+	if len(addr) == 0 {
+		return "", fmt.Errorf("The container has no published port")
+	}
+	dsn := "postgres://postgres:jsondump@" + addr[0] + "/jsondump?sslmode=disable"
+
+	d, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return "", err
+	}
+	defer d.Close()
+
+	for start := time.Now(); time.Since(start) < time.Minute; time.Sleep(500 * time.Millisecond) {
+		err = d.Ping()
+		if err == nil {
+			return dsn, nil
+		}
+	}
+	return "", fmt.Errorf("The database did not start: %v", err)
+}
+
+// postgresDsn returns the DSN of the database for testing the PostgreSQL
+// backend. JSONDUMP_POSTGRES_DSN is used if it is set. Otherwise a database
+// is started in a container if docker is available. The empty DSN means
+// that the backend is not tested.
+func postgresDsn(t *testing.T) string {
+	t.Helper()
+	postgres.once.Do(func() {
+		postgres.dsn = os.Getenv("JSONDUMP_POSTGRES_DSN")
+		if postgres.dsn != "" {
+			return
+		}
+		if _, err := exec.LookPath("docker"); err != nil {
+			return
+		}
+		postgres.dsn, postgres.err = startPostgres()
+	})
+	if postgres.err != nil {
+		t.Fatalf("Setting up PostgreSQL failed with error = %v", postgres.err)
+	}
+	return postgres.dsn
+}
+
+// createEmptyPgStore creates a store in the test database after removing
+// all of its tables
+func createEmptyPgStore(t *testing.T) *PgStore {
+	t.Helper()
+	dsn := postgresDsn(t)
+	if dsn == "" {
+		t.Skip("Neither JSONDUMP_POSTGRES_DSN nor docker is available")
+	}
+
+	d, err := sql.Open("postgres", dsn)
+	if err == nil {
+		_, err = d.Exec(`
+DROP TABLE IF EXISTS content, dump, token, schema_version CASCADE;`)
+		_ = d.Close()
+	}
+	if err != nil {
+		t.Fatalf("Emptying the database failed with error = %v", err)
+	}
+
+	s, err := CreatePgStore(dsn, context.TODO())
+	if err != nil {
+		t.Fatalf("Setting up db failed with error = %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func TestPgStoreInstances(t *testing.T) {
+	first := createEmptyPgStore(t)
+
+	// The concurrently starting instances wait for each other to migrate
+	_, err := first.db.Exec(`
+DROP TABLE IF EXISTS content, dump, token, schema_version CASCADE;`)
+	if err != nil {
+		t.Fatalf("Emptying the database failed with error = %v", err)
+	}
+
+	const instances = 4
+	const updates = 10
+	dsn := postgresDsn(t)
+
+	stores := make([]*PgStore, instances)
+	errs := make([]error, instances)
+	var wg sync.WaitGroup
+	for i := range stores {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stores[i], errs[i] = CreatePgStore(dsn, context.TODO())
+		}(i)
+	}
+	wg.Wait()
+	for i := range stores {
+		if errs[i] != nil {
+			t.Fatalf("Starting instance %d failed with error = %v", i, errs[i])
+		}
+		defer stores[i].Close()
+	}
+
+	version, err := first.SchemaVersion()
+	if err != nil {
+		t.Fatalf("SchemaVersion() failed with error = %v", err)
+	}
+	_ = compare(t, "Schema version not expected", len(pgMigrations), version)
+
+	// The updates of the same path by all instances are serialized
+	for i := range stores {
+		wg.Add(1)
+		go func(s *PgStore) {
+			defer wg.Done()
+			for j := 0; j < updates; j++ {
+				_, err := s.Update("counter", func(cur *Content) (string, error) {
+					if cur == nil {
+						return "1", nil
+					}
+					n, err := strconv.Atoi(cur.Text)
+					return strconv.Itoa(n + 1), err
+				})
+				if err != nil {
+					t.Errorf("Update() failed with error = %v", err)
+					return
+				}
+			}
+		}(stores[i])
+	}
+	wg.Wait()
+
+	c, err := first.GetContent("counter", false, 1)
+	if err != nil {
+		t.Fatalf("GetContent() failed with error = %v", err)
+	}
+	texts := make([]string, 0, len(c))
+	for i := range c {
+		texts = append(texts, c[i].Text)
+	}
+	_ = compare(t, "Counter not expected", []string{strconv.Itoa(instances * updates)}, texts)
+}
+
+func TestPgStoreCompactDeleted(t *testing.T) {
+	s := createEmptyPgStore(t)
+	err := s.Add("a", "1")
+	if err != nil {
+		t.Fatalf("Add() failed with error = %v", err)
+	}
+
+	// Another instance deletes the path while it is being compacted
+	tx, err := s.db.Begin()
+	if err == nil {
+		_, err = tx.Exec(`DELETE FROM dump WHERE path = 'a';`)
+	}
+	if err != nil {
+		t.Fatalf("Deleting the path failed with error = %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Compact()
+		done <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	err = tx.Commit()
+	if err != nil {
+		t.Fatalf("Deleting the path failed with error = %v", err)
+	}
+	err = <-done
+	if err != nil {
+		t.Fatalf("Compact() failed with error = %v", err)
+	}
+
+	var count int
+	err = s.db.QueryRow(`SELECT count(*) FROM dump;`).Scan(&count)
+	if err != nil {
+		t.Fatalf("Counting the paths failed with error = %v", err)
+	}
+	_ = compare(t, "Compact() recreated the deleted path", 0, count)
+}
@@ -0,0 +1,169 @@
+package jsondump
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Retention is the policy for keeping the revisions of the paths under the
+// Prefix. The latest revision of a path is never removed by MaxAge or
+// KeepDaily.
+type Retention struct {
+	Prefix string
+
+	// MaxVersions is the maximum number of revisions kept
+	MaxVersions int
+
+	// ReplaceInterval is the time in which a new revision replaces the
+	// previous one
+	ReplaceInterval time.Duration
+
+	// MaxAge removes the revisions older than it. Zero disables.
+	MaxAge time.Duration
+
+	// KeepDaily keeps only the newest revision of each day for the
+	// revisions older than a day and removes those older than KeepDaily
+	// days. Zero disables.
+	KeepDaily int
+}
+
+type retentionJson struct {
+	Prefix          string  `json:"prefix"`
+	MaxVersions     *int    `json:"max-versions"`
+	ReplaceInterval *string `json:"replace-interval"`
+	MaxAge          *string `json:"max-age"`
+	KeepDaily       *int    `json:"keep-daily"`
+}
+
+// ParseRetention parses a JSON array of retention rules. The values missing
+// from a rule are taken from def.
+func ParseRetention(data []byte, def Retention) ([]Retention, error) {
+	var rules []retentionJson
+	err := json.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, err
+	}
+
+	duration := func(s *string, def time.Duration) (time.Duration, error) {
+		if s == nil {
+			return def, nil
+		}
+		return time.ParseDuration(*s)
+	}
+
+	ret := make([]Retention, 0, len(rules))
+	for i := range rules {
+		r := def
+		rj := &rules[i]
+
+		r.Prefix = rj.Prefix
+		if rj.MaxVersions != nil {
+			r.MaxVersions = *rj.MaxVersions
+		}
+		if rj.KeepDaily != nil {
+			r.KeepDaily = *rj.KeepDaily
+		}
+		r.ReplaceInterval, err = duration(rj.ReplaceInterval, r.ReplaceInterval)
+		if err == nil {
+			r.MaxAge, err = duration(rj.MaxAge, r.MaxAge)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Retention rule for %q: %v", r.Prefix, err)
+		}
+		if r.MaxVersions < 1 {
+			return nil, fmt.Errorf("Retention rule for %q: max-versions must be positive",
+				r.Prefix)
+		}
+
+		ret = append(ret, r)
+	}
+
+	return ret, nil
+}
+
+// LoadRetention reads the retention rules from the file
+func LoadRetention(filename string, def Retention) ([]Retention, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRetention(data, def)
+}
+
+// hasPathPrefix returns true if the path is the prefix or below it. Prefixes
+// are matched on the '/' boundaries and the leading and trailing slashes are
+// ignored. The empty prefix contains all paths.
+func hasPathPrefix(path, prefix string) bool {
+	path = strings.Trim(path, "/")
+	prefix = strings.Trim(prefix, "/")
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// matchRetention returns the rule with the longest prefix that contains the
+// path. Returns def if no rule matches.
+func matchRetention(rules []Retention, path string, def Retention) Retention {
+	ret := def
+	best := -1
+	for i := range rules {
+		prefix := strings.Trim(rules[i].Prefix, "/")
+		if !hasPathPrefix(path, prefix) {
+			continue
+		}
+		if len(prefix) > best {
+			best = len(prefix)
+			ret = rules[i]
+		}
+	}
+
+	return ret
+}
+
+// RetentionPolicy holds the default retention of a store and the rules for
+// path prefixes.
+type RetentionPolicy struct {
+	MaxVersions     int
+	ReplaceInterval time.Duration
+
+	mutex   sync.RWMutex
+	rules   []Retention
+	removed int64
+}
+
+// SetRules sets the retention rules for path prefixes. The paths that match
+// no rule use MaxVersions and ReplaceInterval.
+func (p *RetentionPolicy) SetRules(rules []Retention) {
+	p.mutex.Lock()
+	p.rules = rules
+	p.mutex.Unlock()
+}
+
+// Removed returns the number of revisions removed by the retention policy
+// since the store was opened
+func (p *RetentionPolicy) Removed() int64 {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return p.removed
+}
+
+// countRemoved adds n to the removed revisions
+func (p *RetentionPolicy) countRemoved(n int64) {
+	p.mutex.Lock()
+	p.removed += n
+	p.mutex.Unlock()
+}
+
+// lookup returns the retention of the path
+func (p *RetentionPolicy) lookup(path string) Retention {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return matchRetention(p.rules, path, Retention{
+		MaxVersions:     p.MaxVersions,
+		ReplaceInterval: p.ReplaceInterval,
+	})
+}
@@ -0,0 +1,81 @@
+package jsondump
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRetention(t *testing.T) {
+	def := Retention{MaxVersions: 10, ReplaceInterval: time.Hour}
+
+	tests := []struct {
+		name    string
+		data    string
+		want    []Retention
+		wantErr bool
+	}{
+		{"No rules", `[]`, []Retention{}, false},
+		{"Defaults", `[{"prefix":"a"}]`, []Retention{
+			{Prefix: "a", MaxVersions: 10, ReplaceInterval: time.Hour},
+		}, false},
+		{"All values", `[{"prefix":"a","max-versions":3,"replace-interval":"0s",
+			"max-age":"720h","keep-daily":7}]`, []Retention{
+			{Prefix: "a", MaxVersions: 3, ReplaceInterval: 0,
+				MaxAge: 720 * time.Hour, KeepDaily: 7},
+		}, false},
+		{"Multiple rules", `[{"prefix":"a","max-versions":3},{"prefix":"b","max-age":"1h"}]`,
+			[]Retention{
+				{Prefix: "a", MaxVersions: 3, ReplaceInterval: time.Hour},
+				{Prefix: "b", MaxVersions: 10, ReplaceInterval: time.Hour,
+					MaxAge: time.Hour},
+			}, false},
+		{"Invalid JSON", `[{"prefix":`, nil, true},
+		{"Invalid duration", `[{"prefix":"a","max-age":"forever"}]`, nil, true},
+		{"Invalid max versions", `[{"prefix":"a","max-versions":0}]`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRetention([]byte(tt.data), def)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseRetention() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			_ = compare(t, "ParseRetention() not expected", tt.want, got)
+		})
+	}
+}
+
+func TestMatchRetention(t *testing.T) {
+	def := Retention{Prefix: "default"}
+	rules := []Retention{
+		{Prefix: "/a"},
+		{Prefix: "a/b/"},
+		{Prefix: "c%"},
+	}
+
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"No match", "b", "default"},
+		{"Exact match", "a", "/a"},
+		{"Exact match with slashes", "/a/", "/a"},
+		{"Subpath", "a/c", "/a"},
+		{"Longest prefix", "a/b/c", "a/b/"},
+		{"Only on path boundaries", "ab", "default"},
+		{"No wildcards", "cd", "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := matchRetention(rules, tt.path, def)
+			_ = compare(t, "matchRetention() not expected", tt.want, got.Prefix)
+		})
+	}
+
+	got := matchRetention(append(rules, Retention{Prefix: ""}), "b", def)
+	_ = compare(t, "Empty prefix not matched", "", got.Prefix)
+}
@@ -0,0 +1,225 @@
+package jsondump
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"html"
+	"strings"
+)
+
+// ErrNoSearchIndex is returned when searching a store that has no
+// full-text search index
+var ErrNoSearchIndex = errors.New("Full-text search index is not enabled")
+
+// SearchQuery is a full-text search of the latest revisions
+type SearchQuery struct {
+	// Query is the search expression in the FTS5 query syntax of SQLite,
+	// e.g. "disk full" or "error OR warning"
+	Query string
+
+	// Prefix limits the search to the prefix and the paths below it
+	Prefix string
+
+	// Offset is the number of the best results to skip
+	Offset int
+
+	// Limit is the maximum number of results. Zero or negative means all.
+	Limit int
+}
+
+// SearchResult is a path matching the search. The Snippet is a part of the
+// indexed text escaped as HTML with the matches surrounded by <mark> and
+// </mark>.
+type SearchResult struct {
+	Path    string
+	Id      int
+	Score   float64
+	Snippet string
+}
+
+// Searcher is implemented by the stores with a full-text search index
+type Searcher interface {
+	Search(q *SearchQuery) ([]SearchResult, error)
+}
+
+// Search returns the results of the query from the store, best first
+func Search(s Store, q *SearchQuery) ([]SearchResult, error) {
+	if f, ok := s.(Searcher); ok {
+		return f.Search(q)
+	}
+	return nil, ErrNoSearchIndex
+}
+
+// searchText returns the indexed text of the content. It has the member
+// names and the scalar values of the JSON document separated by spaces. The
+// content that is not JSON is indexed as such.
+func searchText(content string) string {
+	doc, err := decodeJson(content)
+	if err != nil {
+		return content
+	}
+
+	var words []string
+	var walk func(value interface{})
+	walk = func(value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for _, k := range sortedKeys(v) {
+				words = append(words, k)
+				walk(v[k])
+			}
+		case []interface{}:
+			for i := range v {
+				walk(v[i])
+			}
+		case string:
+			words = append(words, v)
+		case json.Number:
+			words = append(words, v.String())
+		case bool:
+			if v {
+				words = append(words, "true")
+			} else {
+				words = append(words, "false")
+			}
+		}
+	}
+	walk(doc)
+
+	return strings.Join(words, " ")
+}
+
+// The snippets are marked with control characters, which are removed from
+// the indexed text, until they are escaped
+const (
+	snippetStart = "\x02"
+	snippetEnd   = "\x03"
+)
+
+var (
+	snippetMarks   = strings.NewReplacer(snippetStart, "<mark>", snippetEnd, "</mark>")
+	snippetRemover = strings.NewReplacer(snippetStart, "", snippetEnd, "")
+)
+
+// snippetHtml escapes the snippet as HTML and marks the matches
+func snippetHtml(snippet string) string {
+	return snippetMarks.Replace(html.EscapeString(snippet))
+}
+
+const createSearchIndex = `
+CREATE VIRTUAL TABLE IF NOT EXISTS search USING fts5(path UNINDEXED, text);
+`
+
+// rowQuerier is a database or a transaction
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// hasSearchIndex checks if the full-text search index has been created. It
+// is checked on each use as the index may be created or dropped by another
+// process.
+func (db *Db) hasSearchIndex(q rowQuerier) (bool, error) {
+	var count int
+	err := q.QueryRowContext(db.ctx, `
+SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'search';`).Scan(&count)
+	return count > 0, err
+}
+
+// index replaces the indexed text of the path with the content
+func (db *Db) index(tx *sql.Tx, path, content string) error {
+	queries := []string{
+		`DELETE FROM search WHERE rowid = (SELECT id FROM dump WHERE path = @path);`,
+		`INSERT INTO search(rowid, path, text)
+SELECT id, path, @text FROM dump WHERE path = @path;`,
+	}
+	return db.execTx(tx, queries,
+		sql.Named("path", path),
+		sql.Named("text", snippetRemover.Replace(searchText(content))),
+	)
+}
+
+// RebuildSearchIndex creates the full-text search index from the latest
+// revisions of the paths. The index is then kept up to date by all writers
+// of the database until it is dropped.
+func (db *Db) RebuildSearchIndex() error {
+	content, err := db.GetContent("", true, 1)
+	if err != nil {
+		return err
+	}
+
+	return db.transaction(func(tx *sql.Tx) error {
+		err := db.execTx(tx, []string{createSearchIndex, `DELETE FROM search;`})
+		if err != nil {
+			return err
+		}
+
+		for i := range content {
+			err = db.index(tx, content[i].Path, content[i].Text)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DropSearchIndex removes the full-text search index
+func (db *Db) DropSearchIndex() error {
+	return db.exec([]string{`DROP TABLE IF EXISTS search;`})
+}
+
+// Search finds the paths matching the query from the full-text search
+// index
+func (db *Db) Search(q *SearchQuery) ([]SearchResult, error) {
+	search, err := db.hasSearchIndex(db.db)
+	if err != nil {
+		return nil, err
+	}
+	if !search {
+		return nil, ErrNoSearchIndex
+	}
+
+	query := `
+SELECT search.path,
+       (SELECT content.id FROM content WHERE content.dumpid = search.rowid
+        ORDER BY content.added DESC, content.id DESC LIMIT 1),
+       -bm25(search),
+       snippet(search, 1, char(2), char(3), '...', 16)
+FROM search
+WHERE search MATCH @query AND
+  (search.path = @path OR (@recursive AND search.path LIKE @subtree ESCAPE '\'))
+ORDER BY rank
+LIMIT @limit OFFSET @offset;
+`
+	ret := []SearchResult{}
+
+	row := func(rows *sql.Rows) error {
+		var r SearchResult
+		err := rows.Scan(&r.Path, &r.Id, &r.Score, &r.Snippet)
+		if err != nil {
+			return err
+		}
+		r.Snippet = snippetHtml(r.Snippet)
+		ret = append(ret, r)
+		return nil
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+
+	args := append(pathArgs(q.Prefix, true),
+		sql.Named("query", q.Query),
+		sql.Named("limit", limit),
+		sql.Named("offset", q.Offset),
+	)
+
+	err = db.query(query, row, args...)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
@@ -0,0 +1,156 @@
+package jsondump
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSearchText(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"Scalar", `"abc"`, "abc"},
+		{"Object", `{"b":{"c":[1,true,null]},"a":"x y"}`, "a x y b c 1 true"},
+		{"Not JSON", `some text`, "some text"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_ = compare(t, "searchText() not expected", tt.want, searchText(tt.content))
+		})
+	}
+}
+
+// openSearchDb creates a database with the search index. Skips the test if
+// the FTS5 module is not built in.
+func openSearchDb(t *testing.T) *Db {
+	_ = os.Remove(dbfile)
+	db, err := CreateDb(dbfile, context.TODO())
+	if err != nil {
+		t.Fatalf("Setting up db failed with error = %v", err)
+	}
+
+	err = db.RebuildSearchIndex()
+	if err != nil && strings.Contains(err.Error(), "no such module") {
+		db.Close()
+		t.Skip("The FTS5 module requires building with -tags sqlite_fts5")
+	}
+	if err != nil {
+		db.Close()
+		t.Fatalf("Creating the search index failed with error = %v", err)
+	}
+	return db
+}
+
+func TestSearch(t *testing.T) {
+	expectSearch := func(db *Db, q SearchQuery, results ...string) {
+		t.Helper()
+		r, err := db.Search(&q)
+		if err != nil {
+			t.Errorf("Search(%q) failed with error = %v", q.Query, err)
+			return
+		}
+		got := make([]string, 0, len(r))
+		for i := range r {
+			got = append(got, r[i].Path+": "+r[i].Snippet)
+		}
+		_ = compare(t, "Search() not expected", results, got)
+	}
+
+	db := openSearchDb(t)
+	// The db is reopened below
+	defer func() {
+		db.Close()
+	}()
+
+	err := db.Add("/a", `{"msg":"disk full","host":"alpha"}`)
+	if err == nil {
+		err = db.Add("/b/c", `{"msg":"disk ok","host":"beta"}`)
+	}
+	if err == nil {
+		err = db.Add("/b/d", `{"msg":"network down"}`)
+	}
+	if err != nil {
+		t.Fatalf("Adding content failed with error = %v", err)
+	}
+
+	expectSearch(db, SearchQuery{Query: "full"}, "/a: host alpha msg disk <mark>full</mark>")
+	expectSearch(db, SearchQuery{Query: "disk", Prefix: "/b"},
+		"/b/c: host beta msg <mark>disk</mark> ok")
+	expectSearch(db, SearchQuery{Query: "down OR full"},
+		"/b/d: msg network <mark>down</mark>",
+		"/a: host alpha msg disk <mark>full</mark>")
+	expectSearch(db, SearchQuery{Query: "down OR full", Limit: 1, Offset: 1},
+		"/a: host alpha msg disk <mark>full</mark>")
+
+	// The index follows the latest revision
+	err = db.Add("/a", `{"msg":"disk cleaned"}`)
+	if err != nil {
+		t.Fatalf("Adding content failed with error = %v", err)
+	}
+	expectSearch(db, SearchQuery{Query: "full"}, []string{}...)
+	expectSearch(db, SearchQuery{Query: "cleaned"}, "/a: msg disk <mark>cleaned</mark>")
+
+	err = db.Delete("/b", true)
+	if err != nil {
+		t.Fatalf("Deleting failed with error = %v", err)
+	}
+	expectSearch(db, SearchQuery{Query: "disk"}, "/a: msg <mark>disk</mark> cleaned")
+
+	// The index is kept up to date after reopening
+	db.Close()
+	db, err = CreateDb(dbfile, context.TODO())
+	if err != nil {
+		t.Fatalf("Reopening db failed with error = %v", err)
+	}
+	err = db.Add("/e", `"full again"`)
+	if err != nil {
+		t.Fatalf("Adding content failed with error = %v", err)
+	}
+	expectSearch(db, SearchQuery{Query: "full"}, "/e: <mark>full</mark> again")
+
+	// The snippets are escaped
+	err = db.Add("/f", `"<b>urgent</b> & more"`)
+	if err != nil {
+		t.Fatalf("Adding content failed with error = %v", err)
+	}
+	expectSearch(db, SearchQuery{Query: "urgent"},
+		"/f: &lt;b&gt;<mark>urgent</mark>&lt;/b&gt; &amp; more")
+
+	// The index is dropped and rebuilt by another process
+	other, err := CreateDb(dbfile, context.TODO())
+	if err != nil {
+		t.Fatalf("Opening db failed with error = %v", err)
+	}
+	defer other.Close()
+
+	err = other.DropSearchIndex()
+	if err != nil {
+		t.Fatalf("Dropping the index failed with error = %v", err)
+	}
+	_, err = db.Search(&SearchQuery{Query: "full"})
+	if err != ErrNoSearchIndex {
+		t.Errorf("Search() error = %v, want %v", err, ErrNoSearchIndex)
+	}
+	err = db.Add("/g", `"full without index"`)
+	if err == nil {
+		err = db.Delete("/f", false)
+	}
+	if err != nil {
+		t.Fatalf("Writing without the index failed with error = %v", err)
+	}
+
+	err = other.RebuildSearchIndex()
+	if err != nil {
+		t.Fatalf("Rebuilding the index failed with error = %v", err)
+	}
+	err = db.Add("/h", `"full with index"`)
+	if err != nil {
+		t.Fatalf("Adding content failed with error = %v", err)
+	}
+	expectSearch(db, SearchQuery{Query: "without"}, "/g: full <mark>without</mark> index")
+	expectSearch(db, SearchQuery{Query: "with"}, "/h: full <mark>with</mark> index")
+}
@@ -0,0 +1,83 @@
+package jsondump
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// Store is a storage of JSON dumps. Each path has revisions of which the
+// latest is its current content.
+type Store interface {
+	// Add stores the content as a new revision of the path
+	Add(path, content string) error
+
+	// Update adds the content returned by fn as a new revision of the
+	// path. The fn gets the latest revision of the path, or nil if there
+	// is none. The read and the write are atomic. Returns the added
+	// revision.
+	Update(path string, fn func(cur *Content) (string, error)) (*Content, error)
+
+	// Delete removes the path. If recursive is set, removes also the paths
+	// below it.
+	Delete(path string, recursive bool) error
+
+	// DeleteIf removes the path like Delete if fn returns no error. The fn
+	// gets the latest revision of the path, or nil if there is none. The
+	// read and the removal are atomic. Returns the latest revision of the
+	// path before the removal.
+	DeleteIf(path string, recursive bool, fn func(cur *Content) error) (*Content, error)
+
+	// GetPaths lists the stored paths in ascending order
+	GetPaths() ([]string, error)
+
+	// ListPaths lists a page of the stored paths with their information in
+	// ascending order
+	ListPaths(q *ListQuery) ([]PathInfo, error)
+
+	// GetContent gets the numLatest revisions of the path. If numLatest is
+	// negative, gets all revisions. If recursive is set, gets also the
+	// revisions of the paths below it.
+	GetContent(path string, recursive bool, numLatest int) ([]Content, error)
+
+	// GetContentAt gets the newest revision of the path that was added at
+	// or before the given time. If recursive is set, gets also the
+	// revisions of the paths below it.
+	GetContentAt(path string, recursive bool, at time.Time) ([]Content, error)
+
+	// GetHistory lists the revisions of the path, newest first
+	GetHistory(path string) ([]Revision, error)
+
+	// GetRevision gets the revision id of the path
+	GetRevision(path string, id int) ([]Content, error)
+
+	// Retention returns the retention policy of the store
+	Retention() *RetentionPolicy
+
+	// Compact applies the retention policy to all paths. Returns the
+	// number of removed revisions.
+	Compact() (int64, error)
+
+	Close() error
+}
+
+// Backends are the names of the available storage backends
+var Backends = []string{"sqlite", "memory", "file", "postgres"}
+
+// OpenStore opens the storage backend. The location is the directory of the
+// sqlite and file backends and the connection string of the postgres
+// backend.
+func OpenStore(backend string, location string, ctx context.Context) (Store, error) {
+	switch backend {
+	case "sqlite":
+		return CreateDb(filepath.Join(location, "jsondump.sqlite3"), ctx)
+	case "memory":
+		return NewMemStore(), nil
+	case "file":
+		return NewFileStore(location)
+	case "postgres":
+		return CreatePgStore(location, ctx)
+	}
+	return nil, fmt.Errorf("Unknown storage backend: %s", backend)
+}
@@ -0,0 +1,127 @@
+package jsondump
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/kopoli/appkit"
+)
+
+// CertPermission grants the Permissions to the paths under the Prefix to
+// the client certificates with the Subject. The subject is either the
+// common name or the whole distinguished name, e.g. "CN=ci,O=Example".
+type CertPermission struct {
+	Subject     string `json:"subject"`
+	Prefix      string `json:"prefix"`
+	Permissions string `json:"permissions"`
+}
+
+// ParseCertPermissions parses a JSON array of client certificate
+// permissions
+func ParseCertPermissions(data []byte) ([]CertPermission, error) {
+	var ret []CertPermission
+	err := json.Unmarshal(data, &ret)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range ret {
+		if ret[i].Subject == "" {
+			return nil, fmt.Errorf("Certificate permission %d has no subject", i)
+		}
+		err = checkPermissions(ret[i].Permissions)
+		if err != nil {
+			return nil, fmt.Errorf("Certificate permission for %q: %v",
+				ret[i].Subject, err)
+		}
+		ret[i].Prefix = strings.Trim(ret[i].Prefix, "/")
+	}
+
+	return ret, nil
+}
+
+// LoadCertPermissions reads the client certificate permissions from the
+// file
+func LoadCertPermissions(filename string) ([]CertPermission, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCertPermissions(data)
+}
+
+// certToken returns the token of the verified client certificate or nil if
+// it has no permissions. If perms is nil, all certificates have all
+// permissions.
+func certToken(cert *x509.Certificate, perms []CertPermission) *Token {
+	subject := cert.Subject.String()
+	if perms == nil {
+		return &Token{Name: subject, Permissions: "rwd"}
+	}
+
+	for i := range perms {
+		if perms[i].Subject == cert.Subject.CommonName || perms[i].Subject == subject {
+			return &Token{
+				Name:        subject,
+				Prefix:      perms[i].Prefix,
+				Permissions: perms[i].Permissions,
+			}
+		}
+	}
+	return nil
+}
+
+// loadCertPool reads a PEM bundle of CA certificates
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificates found in %s", filename)
+	}
+	return pool, nil
+}
+
+// ServerTLSConfig creates the TLS configuration of the server from the
+// tls-cert and tls-key options. Client certificates are verified against
+// the tls-client-ca bundle if it is set. They are then required unless the
+// auth option allows using tokens instead. Returns nil if tls-cert is not
+// set.
+func ServerTLSConfig(opts appkit.Options) (*tls.Config, error) {
+	if !opts.IsSet("tls-cert") {
+		if opts.IsSet("tls-client-ca") {
+			return nil, fmt.Errorf("Verifying client certificates requires a server certificate")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(opts.Get("tls-cert", ""), opts.Get("tls-key", ""))
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if opts.IsSet("tls-client-ca") {
+		ret.ClientCAs, err = loadCertPool(opts.Get("tls-client-ca", ""))
+		if err != nil {
+			return nil, err
+		}
+		ret.ClientAuth = tls.RequireAndVerifyClientCert
+		if opts.IsSet("auth") {
+			ret.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	return ret, nil
+}
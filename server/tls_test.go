@@ -0,0 +1,68 @@
+package jsondump
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+)
+
+func TestParseCertPermissions(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []CertPermission
+		wantErr bool
+	}{
+		{"Empty", `[]`, []CertPermission{}, false},
+		{"Permissions", `[{"subject":"ci","prefix":"/builds/","permissions":"rw"}]`,
+			[]CertPermission{{Subject: "ci", Prefix: "builds", Permissions: "rw"}}, false},
+		{"No subject", `[{"permissions":"r"}]`, nil, true},
+		{"Unknown permission", `[{"subject":"ci","permissions":"x"}]`, nil, true},
+		{"Invalid JSON", `[{`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCertPermissions([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseCertPermissions() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr {
+				_ = compare(t, "ParseCertPermissions() not expected", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCertToken(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject: pkix.Name{CommonName: "ci", Organization: []string{"Example"}},
+	}
+	perms := []CertPermission{
+		{Subject: "other", Permissions: "rwd"},
+		{Subject: "CN=ci,O=Example", Prefix: "builds", Permissions: "rw"},
+	}
+
+	tests := []struct {
+		name  string
+		perms []CertPermission
+		want  Token
+	}{
+		{"All allowed", nil, Token{Name: "CN=ci,O=Example", Permissions: "rwd"}},
+		{"Distinguished name", perms,
+			Token{Name: "CN=ci,O=Example", Prefix: "builds", Permissions: "rw"}},
+		{"Common name", []CertPermission{{Subject: "ci", Permissions: "r"}},
+			Token{Name: "CN=ci,O=Example", Permissions: "r"}},
+		{"Unknown subject", perms[:1], Token{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The zero token stands for no token
+			var got Token
+			if tok := certToken(cert, tt.perms); tok != nil {
+				got = *tok
+			}
+			_ = compare(t, "certToken() not expected", tt.want, got)
+		})
+	}
+}
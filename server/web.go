@@ -1,16 +1,27 @@
 package jsondump
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"mime"
+	"net"
 	"net/http"
 	"net/http/pprof"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/kopoli/appkit"
@@ -43,31 +54,69 @@ func (w *CodeResponseWriter) Write(b []byte) (int, error) {
 	return l, err
 }
 
-func logHandler() middleware {
+// Unwrap returns the underlying writer for http.ResponseController
+func (w *CodeResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush sends the buffered data to the client if the underlying writer
+// supports it
+func (w *CodeResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the handler take over the connection, e.g. for WebSockets
+func (w *CodeResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("Hijacking the connection is not supported")
+	}
+	w.Code = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func logHandler(l *Logger) middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			start := time.Now()
 			cw := &CodeResponseWriter{w, 0, 0}
 			next.ServeHTTP(cw, r)
 			dur := time.Since(start)
-			log.Printf("%s %d %s %d %s %s", r.RemoteAddr, cw.Code, dur.String(), cw.Len, r.Method, r.URL.String())
+
+			level := LevelInfo
+			if cw.Code >= http.StatusInternalServerError {
+				level = LevelError
+			}
+			l.Log(level, "request", "remote", r.RemoteAddr, "status", cw.Code,
+				"duration", dur, "bytes", cw.Len, "method", r.Method,
+				"url", r.URL.String(), "request_id", requestId(r))
 		})
 	}
 }
 
 type RestApi struct {
 	prefix  string
-	db      *Db
+	db      Store
 	dbMutex sync.RWMutex
+	metrics *metrics
+	log     *Logger
+	feed    *feed
 	version string
 }
 
-func wrapJson(data string, err error) []byte {
+// wrapJson wraps the data or the error to the response. The requestId is
+// added to the errors if it is set.
+func wrapJson(data string, err error, requestId string) []byte {
 	status := "success"
 	if err != nil {
 		errstr := strings.Replace(err.Error(), `"`, `\"`, -1)
 		data = fmt.Sprintf(`"%v"`, errstr)
 		status = "fail"
+		if requestId != "" {
+			data += fmt.Sprintf(`, "request_id": "%s"`, requestId)
+		}
 	} else if data == "" {
 		data = `""`
 	}
@@ -79,12 +128,10 @@ func wrapJson(data string, err error) []byte {
 
 func respond(w http.ResponseWriter, data string, err error, code int) {
 	w.Header().Set("Content-Type", "application/json")
-	msg := wrapJson(data, err)
+	msg := wrapJson(data, err, w.Header().Get("X-Request-ID"))
 	w.WriteHeader(code)
-	_, err = w.Write(msg)
-	if err != nil {
-		log.Printf("Write failed with %v", err)
-	}
+	// A failed write is seen in the length of the access log
+	_, _ = w.Write(msg)
 }
 
 func jsonify(data interface{}, err error) (string, error) {
@@ -115,23 +162,364 @@ func parseJson(r io.ReadCloser) (string, error) {
 	return buf.String(), nil
 }
 
+var errPreconditionFailed = errors.New("Precondition failed")
+
+// etag returns the entity tag of the revision
+func etag(c *Content) string {
+	return `"` + strconv.Itoa(c.Id) + `"`
+}
+
+// selectEtag returns the entity tag of the value selected by the JSON path
+// from the revision
+func selectEtag(c *Content, sel string) string {
+	sum := sha256.Sum256([]byte(sel))
+	return `"` + strconv.Itoa(c.Id) + ";sel=" + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// etagMatches returns true if the If-Match or If-None-Match header value
+// matches the entity tag. Weak tags match their strong counterparts.
+func etagMatches(header string, tag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPreconditions checks the If-Match and If-None-Match headers of a
+// write request against the current revision, which is nil if the path has
+// no content.
+func checkPreconditions(r *http.Request, cur *Content) error {
+	if h := r.Header.Get("If-Match"); h != "" {
+		if cur == nil || !etagMatches(h, etag(cur)) {
+			return errPreconditionFailed
+		}
+	}
+	if h := r.Header.Get("If-None-Match"); h != "" {
+		if cur != nil && etagMatches(h, etag(cur)) {
+			return errPreconditionFailed
+		}
+	}
+	return nil
+}
+
+// patchFunc returns the function that applies the patch body of the given
+// content type to a revision. Returns also the HTTP status code on failure.
+func patchFunc(contentType string, body []byte) (func(*Content) (string, error), int, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, http.StatusUnsupportedMediaType, err
+	}
+
+	current := func(cur *Content) string {
+		if cur == nil {
+			return ""
+		}
+		return cur.Text
+	}
+
+	switch mediaType {
+	case "application/json-patch+json":
+		var ops []PatchOp
+		err = json.Unmarshal(body, &ops)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		return func(cur *Content) (string, error) {
+			return ApplyPatch(current(cur), ops)
+		}, http.StatusOK, nil
+	case "application/merge-patch+json":
+		if !json.Valid(body) {
+			return nil, http.StatusBadRequest, fmt.Errorf("Not valid JSON")
+		}
+		return func(cur *Content) (string, error) {
+			return MergePatch(current(cur), string(body))
+		}, http.StatusOK, nil
+	}
+
+	return nil, http.StatusUnsupportedMediaType,
+		fmt.Errorf("Unsupported patch type: %s", mediaType)
+}
+
+// revisionRange parses the optional from and to revision ids. Missing ids
+// are returned as zero.
+func revisionRange(q url.Values) (from int, to int, err error) {
+	parse := func(name string) (int, error) {
+		v := q.Get(name)
+		if v == "" {
+			return 0, nil
+		}
+		return strconv.Atoi(v)
+	}
+
+	from, err = parse("from")
+	if err != nil {
+		return
+	}
+	to, err = parse("to")
+	return
+}
+
+// diff returns the JSON Patch between the revisions from and to of the
+// path. If to is zero, the latest revision is used. If from is zero, the
+// revision preceding to is used.
+func (ra *RestApi) diff(path string, from, to int) ([]PatchOp, error) {
+	hist, err := ra.db.GetHistory(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(hist) == 0 {
+		return nil, fmt.Errorf("No revisions found")
+	}
+
+	if to == 0 {
+		to = hist[0].Id
+	}
+	if from == 0 {
+		for i := range hist {
+			if hist[i].Id == to && i+1 < len(hist) {
+				from = hist[i+1].Id
+				break
+			}
+		}
+		if from == 0 {
+			return nil, fmt.Errorf("No revision preceding %d found", to)
+		}
+	}
+
+	text := func(id int) (string, error) {
+		c, err := ra.db.GetRevision(path, id)
+		if err != nil {
+			return "", err
+		}
+		if len(c) == 0 {
+			return "", fmt.Errorf("Revision %d not found", id)
+		}
+		return c[0].Text, nil
+	}
+
+	a, err := text(from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := text(to)
+	if err != nil {
+		return nil, err
+	}
+
+	return Diff(a, b)
+}
+
+// selectContent replaces the texts of the revisions in data with the values
+// selected by the JSON path
+func selectContent(data interface{}, p *jsonPath) (interface{}, error) {
+	c, ok := data.([]Content)
+	if !ok {
+		return nil, fmt.Errorf("Select is not supported with this query")
+	}
+
+	var err error
+	for i := range c {
+		c[i].Text, err = p.selectFrom(c[i].Text)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// defaultPageSize is the number of results returned when no limit is given
+const defaultPageSize = 100
+
+// pageLimit parses the limit query parameter
+func pageLimit(q url.Values) (int, error) {
+	v := q.Get("limit")
+	if v == "" {
+		return defaultPageSize, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err == nil && limit < 1 {
+		err = fmt.Errorf("Limit must be positive")
+	}
+	return limit, err
+}
+
+// find returns the paths matching the field query. The Next is set to the
+// cursor of the following page if there are more results.
+func (ra *RestApi) find(q url.Values) (interface{}, error) {
+	limit, err := pageLimit(q)
+	if err != nil {
+		return nil, err
+	}
+
+	op := q.Get("op")
+	if op == "" {
+		op = "eq"
+		if !isSet(q, "value") {
+			op = "exists"
+		}
+	}
+
+	results, err := Find(ra.db, &FindQuery{
+		Prefix: q.Get("prefix"),
+		Field:  q.Get("field"),
+		Op:     op,
+		Value:  q.Get("value"),
+		After:  q.Get("after"),
+		Limit:  limit + 1,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := struct {
+		Results []FindResult
+		Next    string
+	}{Results: results}
+	if len(results) > limit {
+		ret.Results = results[:limit]
+		ret.Next = results[limit-1].Path
+	}
+	return ret, nil
+}
+
+// list returns a page of the paths or of the children of the prefix in the
+// tree mode. The Next is set to the cursor of the following page if there
+// are more results.
+func (ra *RestApi) list(q url.Values) (interface{}, error) {
+	limit, err := pageLimit(q)
+	if err != nil {
+		return nil, err
+	}
+
+	if isSet(q, "tree") {
+		entries, next, err := ListTree(ra.db, q.Get("prefix"), q.Get("after"), limit)
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			Results []TreeEntry
+			Next    string
+		}{entries, next}, nil
+	}
+
+	paths, err := ra.db.ListPaths(&ListQuery{
+		Prefix: q.Get("prefix"),
+		After:  q.Get("after"),
+		Limit:  limit + 1,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := struct {
+		Results []PathInfo
+		Next    string
+	}{Results: paths}
+	if len(paths) > limit {
+		ret.Results = paths[:limit]
+		ret.Next = paths[limit-1].Path
+	}
+	return ret, nil
+}
+
+// search returns the paths matching the full-text search. The Next is set
+// to the offset of the following page if there are more results.
+func (ra *RestApi) search(q url.Values) (interface{}, error) {
+	limit, err := pageLimit(q)
+	if err != nil {
+		return nil, err
+	}
+
+	offset := 0
+	if v := q.Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	results, err := Search(ra.db, &SearchQuery{
+		Query:  q.Get("search"),
+		Prefix: q.Get("prefix"),
+		Offset: offset,
+		Limit:  limit + 1,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := struct {
+		Results []SearchResult
+		Next    int
+	}{Results: results}
+	if len(results) > limit {
+		ret.Results = results[:limit]
+		ret.Next = offset + limit
+	}
+	return ret, nil
+}
+
+// observe records the duration of the database operation of the request
+func (ra *RestApi) observe(r *http.Request, op, path string, start time.Time) {
+	dur := time.Since(start)
+	ra.metrics.observeDb(op, dur)
+	ra.log.Debug("database operation", "op", op, "path", path, "duration", dur,
+		"request_id", requestId(r))
+}
+
+// isSet returns true if the query parameter is given, even without a value
+func isSet(q url.Values, name string) bool {
+	_, ok := q[name]
+	return ok
+}
+
 func (ra *RestApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.EscapedPath(), ra.prefix)
 
 	codeFromError := func(err error) int {
-		if err != nil {
+		if err == errPreconditionFailed {
+			return http.StatusPreconditionFailed
+		} else if err == ErrNoSearchIndex {
+			return http.StatusNotImplemented
+		} else if err != nil {
 			return http.StatusBadRequest
 		} else {
 			return http.StatusOK
 		}
 	}
 
-	if path == "/" {
+	// The GET of the root lists the paths in pages. Only with recursive it
+	// falls through to get the latest revisions of all paths.
+	if (path == "" || path == "/") && (r.Method != "GET" || !isSet(r.URL.Query(), "recursive")) {
 		switch r.Method {
 		case "GET":
 			var out string
+			var data interface{}
+			var err error
+			q := r.URL.Query()
+
+			if isSet(q, "watch") {
+				ra.watch(w, r)
+				return
+			}
+
 			ra.dbMutex.RLock()
-			data, err := ra.db.GetPaths()
+			start := time.Now()
+			op := "list"
+			if isSet(q, "find") {
+				op = "find"
+				data, err = ra.find(q)
+			} else if isSet(q, "search") {
+				op = "search"
+				data, err = ra.search(q)
+			} else {
+				data, err = ra.list(q)
+			}
+			ra.observe(r, op, path, start)
 			ra.dbMutex.RUnlock()
 			out, err = jsonify(data, err)
 			respond(w, out, err, codeFromError(err))
@@ -144,25 +532,153 @@ func (ra *RestApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		var out string
+		var data interface{}
+		var err error
+		q := r.URL.Query()
+
+		// The selection is validated before it can match the ETag
+		var sel *jsonPath
+		if isSet(q, "select") {
+			sel, err = parseJsonPath(q.Get("select"))
+			if err != nil {
+				respond(w, "", err, http.StatusBadRequest)
+				return
+			}
+		}
+
 		ra.dbMutex.RLock()
-		data, err := ra.db.GetContent(path, 1)
+		start := time.Now()
+		op := "get"
+		switch {
+		case q.Get("id") != "":
+			op = "revision"
+			var id int
+			id, err = strconv.Atoi(q.Get("id"))
+			if err == nil {
+				data, err = ra.db.GetRevision(path, id)
+			}
+		case q.Get("as-of") != "":
+			op = "get-at"
+			var at time.Time
+			at, err = time.Parse(time.RFC3339Nano, q.Get("as-of"))
+			if err == nil {
+				data, err = ra.db.GetContentAt(path, isSet(q, "recursive"), at)
+			}
+		case isSet(q, "history"):
+			op = "history"
+			data, err = ra.db.GetHistory(path)
+		case isSet(q, "info"):
+			op = "info"
+			var info *PathInfo
+			info, err = GetPathInfo(ra.db, path)
+			if err == nil && info == nil {
+				err = fmt.Errorf("No content found")
+			}
+			data = info
+		case isSet(q, "diff"):
+			op = "diff"
+			var from, to int
+			from, to, err = revisionRange(q)
+			if err == nil {
+				data, err = ra.diff(path, from, to)
+			}
+		default:
+			var c []Content
+			recursive := isSet(q, "recursive")
+			c, err = ra.db.GetContent(path, recursive, 1)
+			if err == nil && !recursive && len(c) == 1 {
+				tag := etag(&c[0])
+				if isSet(q, "select") {
+					tag = selectEtag(&c[0], q.Get("select"))
+				}
+				w.Header().Set("ETag", tag)
+				if etagMatches(r.Header.Get("If-None-Match"), tag) {
+					ra.observe(r, op, path, start)
+					ra.dbMutex.RUnlock()
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+			}
+			data = c
+		}
+		ra.observe(r, op, path, start)
 		ra.dbMutex.RUnlock()
 
+		if err == nil && sel != nil {
+			data, err = selectContent(data, sel)
+		}
+
 		out, err = jsonify(data, err)
 		respond(w, out, err, codeFromError(err))
 		return
 	case "PUT":
+		var c *Content
 		jsdata, err := parseJson(r.Body)
 		if err == nil {
 			ra.dbMutex.Lock()
-			err = ra.db.Add(path, jsdata)
+			start := time.Now()
+			c, err = ra.db.Update(path, func(cur *Content) (string, error) {
+				return jsdata, checkPreconditions(r, cur)
+			})
+			ra.observe(r, "update", path, start)
+			if err == nil {
+				ra.feed.publish(updateChange(c))
+			}
 			ra.dbMutex.Unlock()
 		}
+		if err == nil {
+			w.Header().Set("ETag", etag(c))
+		}
 		respond(w, "", err, codeFromError(err))
 		return
+	case "PATCH":
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			respond(w, "", err, http.StatusBadRequest)
+			return
+		}
+
+		update, code, err := patchFunc(r.Header.Get("Content-Type"), body)
+		if err == nil {
+			var c *Content
+			ra.dbMutex.Lock()
+			start := time.Now()
+			c, err = ra.db.Update(path, func(cur *Content) (string, error) {
+				err := checkPreconditions(r, cur)
+				if err != nil {
+					return "", err
+				}
+				return update(cur)
+			})
+			ra.observe(r, "update", path, start)
+			if err == nil {
+				ra.feed.publish(updateChange(c))
+			}
+			ra.dbMutex.Unlock()
+			code = codeFromError(err)
+			if err == nil {
+				w.Header().Set("ETag", etag(c))
+			}
+		}
+		respond(w, "", err, code)
+		return
 	case "DELETE":
 		ra.dbMutex.Lock()
-		err := ra.db.Delete(path)
+		start := time.Now()
+		recursive := isSet(r.URL.Query(), "recursive")
+		cur, err := ra.db.DeleteIf(path, recursive, func(cur *Content) error {
+			return checkPreconditions(r, cur)
+		})
+		ra.observe(r, "delete", path, start)
+		if err == nil && (recursive || cur != nil) {
+			ra.feed.publish(Change{
+				Type:      "delete",
+				Path:      path,
+				Date:      time.Now(),
+				Recursive: recursive,
+			})
+		}
 		ra.dbMutex.Unlock()
 		respond(w, "", err, codeFromError(err))
 		return
@@ -172,29 +688,85 @@ func (ra *RestApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func CreateHandler(db *Db, opts appkit.Options) http.Handler {
-	var logflags int = 0
-
-	if opts.IsSet("log-timestamps") {
-		logflags = log.LstdFlags
+// handlerLogger returns the logger of the options or the default logger if
+// the options are invalid
+func handlerLogger(opts appkit.Options) *Logger {
+	l, err := loggerFromOptions(opts)
+	if err != nil {
+		l, _ = NewLogger(os.Stderr, LevelInfo, "text")
+		l.Error("Invalid log options, using the defaults", "error", err)
 	}
+	return l
+}
 
-	log.SetFlags(logflags)
+// CreateHandler creates the handler of the API. It records its own
+// metrics, which are not served by a separately created admin handler.
+func CreateHandler(db Store, opts appkit.Options) http.Handler {
+	h, _ := createHandler(db, opts, newMetrics(), newFeed(), handlerLogger(opts))
+	return h
+}
 
+// createHandler creates the handler of CreateHandler that records to the
+// metrics and to the logger and publishes the changes to the feed. Returns
+// also the authenticator of the requests or nil if authentication is not
+// enabled.
+func createHandler(db Store, opts appkit.Options, m *metrics, f *feed, l *Logger) (http.Handler, *authenticator) {
 	r := &RestApi{
 		prefix:  "/api/",
 		db:      db,
+		metrics: m,
+		log:     l,
+		feed:    f,
 		version: opts.Get("program-version", "undefined"),
 	}
 	mux := http.NewServeMux()
 
-	stack := func(h http.Handler) http.Handler {
-		return chain(h,
-			logHandler(),
-		)
+	var api http.Handler = r
+	var ws http.Handler = http.HandlerFunc(r.serveWebSocket)
+	auth := &authenticator{
+		bearer:      opts.IsSet("auth"),
+		clientCerts: opts.IsSet("tls-client-ca"),
 	}
+	if auth.bearer || auth.clientCerts {
+		auth.tokens, _ = db.(TokenStore)
+		if opts.IsSet("tls-client-permissions") {
+			// Deny all certificates if the permissions cannot be read
+			auth.certs = []CertPermission{}
+			err := auth.loadCerts(opts.Get("tls-client-permissions", ""))
+			if err != nil {
+				l.Error("Loading client certificate permissions failed", "error", err)
+			}
+		}
+		api = authHandler(auth, r.prefix)(api)
+		ws = tokenHandler(auth)(ws)
+	} else {
+		auth = nil
+	}
+
+	mux.Handle(r.prefix, api)
+	mux.Handle("/ws", ws)
+
+	// The probes do not need authentication and do not reveal the reasons
+	mux.HandleFunc("/healthz", serveHealth)
+	mux.Handle("/readyz", serveReady(db, false, l))
 
-	mux.Handle(r.prefix, r)
+	return chain(mux, requestIdHandler(), logHandler(l), metricsHandler(m)), auth
+}
+
+// CreateAdminHandler creates the handler of the admin listener. It has the
+// profiling endpoints, the metrics and the probes and should not be
+// reachable by the clients of the API. The metrics have only the store
+// measurements as the requests are recorded by the handler of StartWeb.
+func CreateAdminHandler(db Store, opts appkit.Options) http.Handler {
+	return createAdminHandler(db, opts, newMetrics(), handlerLogger(opts))
+}
+
+func createAdminHandler(db Store, opts appkit.Options, m *metrics, l *Logger) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.Handle("/metrics", serveMetrics(m, db))
+	mux.HandleFunc("/healthz", serveHealth)
+	mux.Handle("/readyz", serveReady(db, true, l))
 
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
@@ -202,15 +774,165 @@ func CreateHandler(db *Db, opts appkit.Options) http.Handler {
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 
-	return stack(mux)
+	return chain(mux, requestIdHandler(), logHandler(l))
 }
 
-func StartWeb(db *Db, opts appkit.Options) error {
-	mux := CreateHandler(db, opts)
+// compact applies the retention rules periodically until stop is closed
+func compact(db Store, interval time.Duration, stop <-chan struct{}, l *Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		n, err := db.Compact()
+		if err != nil {
+			l.Error("Compaction failed", "error", err)
+		} else if n > 0 {
+			l.Info("Compaction removed revisions", "count", n)
+		}
+	}
+}
+
+// reload rereads the retention rules and the client certificate
+// permissions from their files. The tokens are read from the store on each
+// request.
+func reload(db Store, opts appkit.Options, auth *authenticator) error {
+	if opts.IsSet("retention") {
+		rp := db.Retention()
+		rules, err := LoadRetention(opts.Get("retention", ""), Retention{
+			MaxVersions:     rp.MaxVersions,
+			ReplaceInterval: rp.ReplaceInterval,
+		})
+		if err != nil {
+			return err
+		}
+		rp.SetRules(rules)
+	}
+
+	if auth != nil && opts.IsSet("tls-client-permissions") {
+		return auth.loadCerts(opts.Get("tls-client-permissions", ""))
+	}
+	return nil
+}
+
+// listener is a server and the function that runs it
+type listener struct {
+	srv    *http.Server
+	listen func() error
+}
+
+// serve runs the listeners until one of them fails or SIGINT or SIGTERM is
+// received from the signals. Then the servers are shut down after their
+// in-flight requests are finished or the timeout expires. SIGHUP calls
+// onHangup.
+func serve(listeners []listener, signals <-chan os.Signal, timeout time.Duration,
+	onHangup func(), l *Logger) error {
+
+	errs := make(chan error, len(listeners))
+	for i := range listeners {
+		go func(l *listener) {
+			errs <- l.listen()
+		}(&listeners[i])
+	}
+
+	// shutdown stops the servers and returns the first error. The failed
+	// listener has already returned.
+	shutdown := func(failed error) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		ret := failed
+		for i := range listeners {
+			err := listeners[i].srv.Shutdown(ctx)
+			if ret == nil {
+				ret = err
+			}
+		}
+
+		running := len(listeners)
+		if failed != nil {
+			running--
+		}
+		for i := 0; i < running; i++ {
+			if err := <-errs; ret == nil && err != http.ErrServerClosed {
+				ret = err
+			}
+		}
+		return ret
+	}
+
+	for {
+		select {
+		case err := <-errs:
+			return shutdown(err)
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				onHangup()
+				continue
+			}
+
+			l.Info("Shutting down", "signal", sig)
+			return shutdown(nil)
+		}
+	}
+}
+
+// StartWeb runs the web server until SIGINT or SIGTERM. The store is not
+// closed.
+func StartWeb(db Store, opts appkit.Options) error {
+	if _, ok := db.(TokenStore); opts.IsSet("auth") && !ok {
+		return fmt.Errorf("The store does not support tokens")
+	}
+	if opts.IsSet("tls-client-permissions") {
+		_, err := LoadCertPermissions(opts.Get("tls-client-permissions", ""))
+		if err != nil {
+			return err
+		}
+	}
+	tlsConf, err := ServerTLSConfig(opts)
+	if err != nil {
+		return err
+	}
+	l, err := loggerFromOptions(opts)
+	if err != nil {
+		return err
+	}
+
+	timeout, err := time.ParseDuration(opts.Get("shutdown-timeout", "30s"))
+	if err != nil {
+		return err
+	}
+
+	// The admin listener serves the metrics of the API
+	m := newMetrics()
+	changes := newFeed()
+	mux, auth := createHandler(db, opts, m, changes, l)
 
 	addr := opts.Get("address", ":8032")
 
-	log.Println("Starting server at", addr)
+	interval, err := time.ParseDuration(opts.Get("compact-interval", "1h"))
+	if err != nil {
+		return err
+	}
+	if interval > 0 {
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			compact(db, interval, stop, l)
+			close(done)
+		}()
+		defer func() {
+			close(stop)
+			<-done
+		}()
+	}
+
+	l.Info("Starting server", "address", addr)
 
 	srv := &http.Server{
 		Addr:        addr,
@@ -218,7 +940,42 @@ func StartWeb(db *Db, opts appkit.Options) error {
 		ReadTimeout: 20 * time.Second,
 		WriteTimeout: 20 * time.Second,
 		IdleTimeout: 120 * time.Second,
+		TLSConfig:   tlsConf,
 	}
 
-	return srv.ListenAndServe()
+	// The change streams would hold up the shutdown
+	srv.RegisterOnShutdown(changes.close)
+
+	listeners := []listener{{srv, srv.ListenAndServe}}
+	if tlsConf != nil {
+		// The certificate is in the TLSConfig
+		listeners[0].listen = func() error {
+			return srv.ListenAndServeTLS("", "")
+		}
+	}
+
+	if opts.IsSet("admin-address") {
+		// No WriteTimeout as profiling takes 30 seconds by default
+		admin := &http.Server{
+			Addr:        opts.Get("admin-address", ""),
+			Handler:     createAdminHandler(db, opts, m, l),
+			ReadTimeout: 20 * time.Second,
+			IdleTimeout: 120 * time.Second,
+		}
+		l.Info("Starting admin server", "address", admin.Addr)
+		listeners = append(listeners, listener{admin, admin.ListenAndServe})
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	return serve(listeners, signals, timeout, func() {
+		err := reload(db, opts, auth)
+		if err != nil {
+			l.Error("Reloading configuration failed", "error", err)
+		} else {
+			l.Info("Reloaded configuration")
+		}
+	}, l)
 }
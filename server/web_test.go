@@ -0,0 +1,273 @@
+package jsondump
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kopoli/appkit"
+)
+
+func TestServe(t *testing.T) {
+	// startServer serves a handler that blocks until release is closed
+	// along with the extra listeners
+	startServer := func(timeout time.Duration, extra ...listener) (string, chan os.Signal, chan struct{}, <-chan error, <-chan struct{}) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listening failed with error = %v", err)
+		}
+
+		release := make(chan struct{})
+		srv := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				<-release
+				w.WriteHeader(http.StatusOK)
+			}),
+		}
+
+		signals := make(chan os.Signal)
+		hangups := make(chan struct{}, 1)
+		errs := make(chan error, 1)
+		go func() {
+			listeners := append([]listener{{srv, func() error { return srv.Serve(l) }}},
+				extra...)
+			errs <- serve(listeners, signals, timeout, func() { hangups <- struct{}{} }, nil)
+		}()
+		return "http://" + l.Addr().String(), signals, release, errs, hangups
+	}
+
+	get := func(url string) <-chan error {
+		ret := make(chan error, 1)
+		go func() {
+			resp, err := http.Get(url)
+			if err == nil {
+				resp.Body.Close()
+			}
+			ret <- err
+		}()
+		return ret
+	}
+
+	expectRunning := func(errs <-chan error) {
+		t.Helper()
+		select {
+		case err := <-errs:
+			t.Fatalf("serve() returned early with error = %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	t.Run("Finish requests", func(t *testing.T) {
+		url, signals, release, errs, hangups := startServer(time.Minute)
+		req := get(url)
+		time.Sleep(50 * time.Millisecond)
+
+		signals <- syscall.SIGHUP
+		<-hangups
+		expectRunning(errs)
+
+		signals <- syscall.SIGTERM
+		expectRunning(errs)
+
+		close(release)
+		if err := <-req; err != nil {
+			t.Errorf("Request failed with error = %v", err)
+		}
+		if err := <-errs; err != nil {
+			t.Errorf("serve() failed with error = %v", err)
+		}
+	})
+
+	t.Run("Failing listener", func(t *testing.T) {
+		failure := errors.New("Listening failed")
+		_, _, release, errs, _ := startServer(time.Minute, listener{
+			srv:    &http.Server{},
+			listen: func() error { return failure },
+		})
+		defer close(release)
+
+		if err := <-errs; err != failure {
+			t.Errorf("serve() error = %v, want %v", err, failure)
+		}
+	})
+
+	t.Run("Shutdown timeout", func(t *testing.T) {
+		url, signals, release, errs, _ := startServer(50 * time.Millisecond)
+		defer close(release)
+		_ = get(url)
+		time.Sleep(50 * time.Millisecond)
+
+		signals <- syscall.SIGINT
+		if err := <-errs; err != context.DeadlineExceeded {
+			t.Errorf("serve() error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
+
+func TestAdminHandler(t *testing.T) {
+	db := NewMemStore()
+	opts := appkit.NewOptions()
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		path    string
+		want    int
+	}{
+		{"Public API", CreateHandler(db, opts), "/api/a", http.StatusOK},
+		{"Public profiling", CreateHandler(db, opts), "/debug/pprof/", http.StatusNotFound},
+		{"Admin profiling", CreateAdminHandler(db, opts), "/debug/pprof/", http.StatusOK},
+		{"Admin API", CreateAdminHandler(db, opts), "/api/a", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.handler.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+			_ = compare(t, "Status not expected", tt.want, w.Code)
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	retention := filepath.Join(dir, "retention.json")
+	perms := filepath.Join(dir, "permissions.json")
+
+	write := func(name, data string) {
+		t.Helper()
+		err := ioutil.WriteFile(name, []byte(data), 0600)
+		if err != nil {
+			t.Fatalf("Writing %s failed with error = %v", name, err)
+		}
+	}
+	write(retention, `[{"prefix": "a", "max-versions": 2}]`)
+	write(perms, `[{"subject": "ci", "permissions": "r"}]`)
+
+	db := NewMemStore()
+	db.Retention().MaxVersions = 5
+
+	opts := appkit.NewOptions()
+	opts.Set("retention", retention)
+	opts.Set("tls-client-ca", "ca.crt")
+	opts.Set("tls-client-permissions", perms)
+	_, auth := createHandler(db, opts, newMetrics(), newFeed(), nil)
+
+	expect := func(versions int, certs ...CertPermission) {
+		t.Helper()
+		_ = compare(t, "Retention not expected", versions, db.Retention().lookup("a/b").MaxVersions)
+		_ = compare(t, "Certificate permissions not expected", certs, auth.certs)
+	}
+
+	expect(5, CertPermission{Subject: "ci", Permissions: "r"})
+
+	err := reload(db, opts, auth)
+	if err != nil {
+		t.Fatalf("reload() failed with error = %v", err)
+	}
+	expect(2, CertPermission{Subject: "ci", Permissions: "r"})
+
+	write(retention, `[{"prefix": "a", "max-versions": 3}]`)
+	write(perms, `[{"subject": "ci", "permissions": "rw"}]`)
+	err = reload(db, opts, auth)
+	if err != nil {
+		t.Fatalf("reload() failed with error = %v", err)
+	}
+	expect(3, CertPermission{Subject: "ci", Permissions: "rw"})
+
+	// Invalid files keep the previous configuration
+	write(perms, `[{"subject": "ci", "permissions": "x"}]`)
+	err = reload(db, opts, auth)
+	if err == nil {
+		t.Errorf("reload() of invalid permissions should fail")
+	}
+	expect(3, CertPermission{Subject: "ci", Permissions: "rw"})
+}
+
+func TestSelectEtag(t *testing.T) {
+	db := NewMemStore()
+	err := db.Add("a", `{"x":1,"y":2}`)
+	if err != nil {
+		t.Fatalf("Adding content failed with error = %v", err)
+	}
+	h, _ := createHandler(db, appkit.NewOptions(), newMetrics(), newFeed(), nil)
+
+	get := func(url, ifNoneMatch string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", url, nil)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	whole := get("/api/a", "").Header().Get("ETag")
+	x := get("/api/a?select=$.x", "").Header().Get("ETag")
+	y := get("/api/a?select=$.y", "").Header().Get("ETag")
+	if whole == "" || x == "" || whole == x || x == y {
+		t.Fatalf("ETags not distinct: %s, %s and %s", whole, x, y)
+	}
+
+	tests := []struct {
+		name        string
+		url         string
+		ifNoneMatch string
+		want        int
+	}{
+		{"Same selection", "/api/a?select=$.x", x, http.StatusNotModified},
+		{"Whole document for selection", "/api/a?select=$.x", whole, http.StatusOK},
+		{"Other selection", "/api/a?select=$.x", y, http.StatusOK},
+		{"Selection for whole document", "/api/a", x, http.StatusOK},
+		{"Whole document", "/api/a", whole, http.StatusNotModified},
+		{"Invalid selection", "/api/a?select=x", "*", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_ = compare(t, "Status not expected", tt.want, get(tt.url, tt.ifNoneMatch).Code)
+		})
+	}
+}
+
+func TestRootListing(t *testing.T) {
+	db := NewMemStore()
+	for i := 0; i <= defaultPageSize; i++ {
+		err := db.Add(fmt.Sprintf("p%03d", i), `1`)
+		if err != nil {
+			t.Fatalf("Adding content failed with error = %v", err)
+		}
+	}
+	h, _ := createHandler(db, appkit.NewOptions(), newMetrics(), newFeed(), nil)
+
+	get := func(url string, data interface{}) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		_ = compare(t, "Status not expected", http.StatusOK, w.Code)
+		err := json.Unmarshal(w.Body.Bytes(), &struct{ Data interface{} }{data})
+		if err != nil {
+			t.Fatalf("Decoding %s failed with error = %v", url, err)
+		}
+	}
+
+	var page struct {
+		Results []PathInfo
+		Next    string
+	}
+	get("/api/", &page)
+	_ = compare(t, "Page size not expected", defaultPageSize, len(page.Results))
+	_ = compare(t, "Next not expected", "p099", page.Next)
+
+	var all []Content
+	get("/api/?recursive", &all)
+	_ = compare(t, "Content count not expected", defaultPageSize+1, len(all))
+}
@@ -0,0 +1,226 @@
+package jsondump
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsWriteWait is the time allowed to write a message
+	wsWriteWait = 10 * time.Second
+
+	// wsPongWait is the time allowed to read the next message or pong
+	wsPongWait = 60 * time.Second
+
+	// wsPingPeriod is the interval of the pings. It is less than
+	// wsPongWait.
+	wsPingPeriod = 50 * time.Second
+
+	// wsMaxMessageSize is the maximum length of a message from the client
+	wsMaxMessageSize = 4096
+)
+
+// upgrader accepts the WebSocket connections from the same origin only
+var upgrader websocket.Upgrader
+
+// wsMessage is a message of the WebSocket protocol other than a change. The
+// client sends the subscribe and unsubscribe messages and the server
+// replies with subscribed, unsubscribed or error. The server sends reset if
+// changes were missed and the subscribed paths should be read again.
+type wsMessage struct {
+	Type   string
+	Prefix string `json:",omitempty"`
+	Error  string `json:",omitempty"`
+}
+
+// wsConn is a WebSocket connection with its subscribed prefixes. The
+// mutex guards the prefixes that the feed reads when publishing.
+type wsConn struct {
+	conn     *websocket.Conn
+	token    *Token
+	mutex    sync.Mutex
+	prefixes map[string]struct{}
+}
+
+func (c *wsConn) write(v interface{}) error {
+	err := c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if err != nil {
+		return err
+	}
+	return c.conn.WriteJSON(v)
+}
+
+// changes returns the changes that the client receives of ch. The change
+// is received if it is under a subscribed prefix and the token permits
+// reading its path. A recursive delete of a path that the token does not
+// permit is narrowed to the permitted subscribed prefixes below it.
+func (c *wsConn) changes(ch *Change) []Change {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.token == nil || c.token.allows('r', ch.Path) {
+		for p := range c.prefixes {
+			if changeMatches(ch, p) {
+				return []Change{*ch}
+			}
+		}
+		return nil
+	}
+
+	if !ch.Recursive {
+		return nil
+	}
+	var paths []string
+	for p := range c.prefixes {
+		if hasPathPrefix(p, ch.Path) && c.token.allows('r', p) {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	ret := make([]Change, 0, len(paths))
+	for _, p := range paths {
+		n := *ch
+		n.Path = p
+		ret = append(ret, n)
+	}
+	return ret
+}
+
+// matches returns true if the client receives any changes of ch
+func (c *wsConn) matches(ch *Change) bool {
+	return len(c.changes(ch)) > 0
+}
+
+// handle handles a message from the client and returns the reply
+func (c *wsConn) handle(data []byte) wsMessage {
+	var m wsMessage
+	err := json.Unmarshal(data, &m)
+	if err != nil {
+		return wsMessage{Type: "error", Error: "Not valid JSON"}
+	}
+
+	prefix := strings.Trim(m.Prefix, "/")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	reply := func(typ string, err error) wsMessage {
+		ret := wsMessage{Type: typ, Prefix: prefix}
+		if err != nil {
+			ret.Type = "error"
+			ret.Error = err.Error()
+		}
+		return ret
+	}
+
+	switch m.Type {
+	case "subscribe":
+		if c.token != nil && !c.token.allows('r', prefix) {
+			return reply("", fmt.Errorf("Permission denied"))
+		}
+		c.prefixes[prefix] = struct{}{}
+		return reply("subscribed", nil)
+	case "unsubscribe":
+		if _, ok := c.prefixes[prefix]; !ok {
+			return reply("", fmt.Errorf("Not subscribed"))
+		}
+		delete(c.prefixes, prefix)
+		return reply("unsubscribed", nil)
+	}
+	return reply("", fmt.Errorf("Unknown message type %q", m.Type))
+}
+
+// serveWebSocket pushes the changes under the prefixes the client subscribes
+// to. The updates include the content of the new revision.
+func (ra *RestApi) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has responded with the error
+		return
+	}
+	defer conn.Close()
+
+	c := &wsConn{
+		conn:     conn,
+		token:    requestToken(r),
+		prefixes: map[string]struct{}{},
+	}
+
+	// Read the messages until the connection fails or is closed
+	messages := make(chan []byte)
+	done := make(chan struct{})
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer close(done)
+
+		conn.SetReadLimit(wsMaxMessageSize)
+		_ = conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(wsPongWait))
+			select {
+			case messages <- data:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	// The feed queues only the changes the client receives
+	s := ra.feed.subscribeFunc(c.matches)
+	defer func() {
+		ra.feed.unsubscribe(s)
+	}()
+
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case data := <-messages:
+			err = c.write(c.handle(data))
+		case e, ok := <-s.events:
+			if !ok {
+				if ra.feed.isClosed() {
+					// Shutting down
+					return
+				}
+
+				// Too slow, the client rereads the paths
+				s = ra.feed.subscribeFunc(c.matches)
+				err = c.write(wsMessage{Type: "reset"})
+			} else {
+				// The subscriptions may have changed after queueing
+				for _, ch := range c.changes(&e.change) {
+					if err == nil {
+						err = c.write(ch)
+					}
+				}
+			}
+		case <-ping.C:
+			err = conn.WriteControl(websocket.PingMessage, nil,
+				time.Now().Add(wsWriteWait))
+		}
+		if err != nil {
+			ra.log.Debug("WebSocket write failed", "error", err,
+				"request_id", requestId(r))
+			return
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package jsondump
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/kopoli/appkit"
+)
+
+// wsTestMessage has the fields of all server messages
+type wsTestMessage struct {
+	Type      string
+	Prefix    string
+	Error     string
+	Path      string
+	Recursive bool
+	Content   json.RawMessage
+}
+
+func TestWebSocket(t *testing.T) {
+	_ = os.Remove(dbfile)
+	db, err := CreateDb(dbfile, context.TODO())
+	if err != nil {
+		t.Fatalf("Setting up db failed with error = %v", err)
+	}
+	defer db.Close()
+
+	var writer string
+	reader, _, err := CreateToken(db, "reader", "a/b", "r")
+	if err == nil {
+		writer, _, err = CreateToken(db, "writer", "", "rwd")
+	}
+	if err != nil {
+		t.Fatalf("Creating token failed with error = %v", err)
+	}
+
+	open, _ := createHandler(db, appkit.NewOptions(), newMetrics(), newFeed(), nil)
+	openSrv := httptest.NewServer(open)
+	defer openSrv.Close()
+
+	opts := appkit.NewOptions()
+	opts.Set("auth", "t")
+	authenticated, _ := createHandler(db, opts, newMetrics(), newFeed(), nil)
+	authSrv := httptest.NewServer(authenticated)
+	defer authSrv.Close()
+
+	dial := func(srv *httptest.Server, header http.Header) (*websocket.Conn, int, error) {
+		url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+		conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+		code := 0
+		if resp != nil {
+			code = resp.StatusCode
+		}
+		return conn, code, err
+	}
+
+	requestTo := func(srv *httptest.Server, method, path, body string) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+"/api/"+path,
+			strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Creating request failed with error = %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+writer)
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Request failed with error = %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s failed with status %d", method, path, resp.StatusCode)
+		}
+	}
+	request := func(method, path, body string) {
+		t.Helper()
+		requestTo(openSrv, method, path, body)
+	}
+
+	t.Run("Subscriptions", func(t *testing.T) {
+		conn, _, err := dial(openSrv, nil)
+		if err != nil {
+			t.Fatalf("Dial failed with error = %v", err)
+		}
+		defer conn.Close()
+
+		expect := func(want wsTestMessage) {
+			t.Helper()
+			var got wsTestMessage
+			_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			err := conn.ReadJSON(&got)
+			if err != nil {
+				t.Fatalf("Reading message failed with error = %v", err)
+			}
+			_ = compare(t, "Message not expected", want, got)
+		}
+		send := func(msg string) {
+			t.Helper()
+			err := conn.WriteMessage(websocket.TextMessage, []byte(msg))
+			if err != nil {
+				t.Fatalf("Sending message failed with error = %v", err)
+			}
+		}
+
+		send(`{"Type":"subscribe","Prefix":"a"}`)
+		expect(wsTestMessage{Type: "subscribed", Prefix: "a"})
+		send(`{"type":"subscribe","prefix":"/b/c/"}`)
+		expect(wsTestMessage{Type: "subscribed", Prefix: "b/c"})
+
+		request("PUT", "c", `"c"`)
+		request("PUT", "a/x", `{"a": 1}`)
+		expect(wsTestMessage{Type: "update", Path: "a/x",
+			Content: json.RawMessage(`{"a":1}`)})
+		request("PUT", "b/c/d", `"d"`)
+		expect(wsTestMessage{Type: "update", Path: "b/c/d",
+			Content: json.RawMessage(`"d"`)})
+
+		send(`{"Type":"unsubscribe","Prefix":"a"}`)
+		expect(wsTestMessage{Type: "unsubscribed", Prefix: "a"})
+		send(`{"Type":"unsubscribe","Prefix":"a"}`)
+		expect(wsTestMessage{Type: "error", Prefix: "a", Error: "Not subscribed"})
+		send(`{"Type":"publish"}`)
+		expect(wsTestMessage{Type: "error", Error: `Unknown message type "publish"`})
+		send(`{"Type":`)
+		expect(wsTestMessage{Type: "error", Error: "Not valid JSON"})
+
+		request("PUT", "a/y", `"y"`)
+		request("DELETE", "b?recursive", "")
+		expect(wsTestMessage{Type: "delete", Path: "b", Recursive: true})
+	})
+
+	t.Run("Other origin", func(t *testing.T) {
+		_, code, err := dial(openSrv, http.Header{"Origin": {"http://example.com"}})
+		if err == nil || code != http.StatusForbidden {
+			t.Errorf("Expected status 403, got %d with error = %v", code, err)
+		}
+	})
+
+	t.Run("No token", func(t *testing.T) {
+		_, code, err := dial(authSrv, nil)
+		if err == nil || code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401, got %d with error = %v", code, err)
+		}
+	})
+
+	t.Run("Token permissions", func(t *testing.T) {
+		conn, _, err := dial(authSrv, http.Header{"Authorization": {"Bearer " + reader}})
+		if err != nil {
+			t.Fatalf("Dial failed with error = %v", err)
+		}
+		defer conn.Close()
+
+		for _, tt := range []struct {
+			msg  string
+			want wsTestMessage
+		}{
+			{`{"Type":"subscribe","Prefix":"b"}`,
+				wsTestMessage{Type: "error", Prefix: "b", Error: "Permission denied"}},
+			{`{"Type":"subscribe"}`,
+				wsTestMessage{Type: "error", Error: "Permission denied"}},
+			{`{"Type":"subscribe","Prefix":"a/b"}`,
+				wsTestMessage{Type: "subscribed", Prefix: "a/b"}},
+		} {
+			var got wsTestMessage
+			err = conn.WriteMessage(websocket.TextMessage, []byte(tt.msg))
+			if err == nil {
+				_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+				err = conn.ReadJSON(&got)
+			}
+			if err != nil {
+				t.Fatalf("Message %s failed with error = %v", tt.msg, err)
+			}
+			_ = compare(t, "Reply not expected", tt.want, got)
+		}
+
+		// The changes outside the token prefix are not received. The
+		// delete of a parent is narrowed to the subscribed prefix.
+		requestTo(authSrv, "PUT", "a/c", `"c"`)
+		requestTo(authSrv, "PUT", "a/b/c", `"d"`)
+		requestTo(authSrv, "DELETE", "a?recursive", "")
+		for _, want := range []wsTestMessage{
+			{Type: "update", Path: "a/b/c", Content: json.RawMessage(`"d"`)},
+			{Type: "delete", Path: "a/b", Recursive: true},
+		} {
+			var got wsTestMessage
+			_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			err = conn.ReadJSON(&got)
+			if err != nil {
+				t.Fatalf("Reading message failed with error = %v", err)
+			}
+			_ = compare(t, "Message not expected", want, got)
+		}
+	})
+}